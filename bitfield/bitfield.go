@@ -20,6 +20,7 @@ type Bitfield interface {
 	Full() bool
 	Range(func(i int, val bool) bool)
 	Difference(Bitfield) (Bitfield, error)
+	Clone() Bitfield
 }
 
 func New(size int) Bitfield {
@@ -109,6 +110,14 @@ func (bf *bitfield) Get(i int) (bool, error) {
 	return bit != 0, nil
 }
 
+// Clone returns copy of bitfield that does not share its bits.
+func (bf *bitfield) Clone() Bitfield {
+	field := make([]byte, len(bf.field))
+	copy(field, bf.field)
+
+	return &bitfield{field: field, size: bf.size}
+}
+
 // PERF: iterating over bytes and using bitwise AND
 func (bf *bitfield) Difference(x Bitfield) (Bitfield, error) {
 	if bf.size != x.Size() {
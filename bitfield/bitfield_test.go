@@ -256,3 +256,24 @@ func TestBitfieldFull(t *testing.T) {
 		})
 	}
 }
+
+func TestBitfieldClone(t *testing.T) {
+	bf := bitfield.New(36)
+	bf.Set(3)
+
+	clone := bf.Clone()
+	bf.Set(5)
+	clone.Set(7)
+
+	if v, _ := clone.Get(3); !v {
+		t.Fatalf("got %t, want %t", v, true)
+	}
+
+	if v, _ := clone.Get(5); v {
+		t.Fatalf("got %t, want %t", v, false)
+	}
+
+	if v, _ := bf.Get(7); v {
+		t.Fatalf("got %t, want %t", v, false)
+	}
+}
@@ -0,0 +1,78 @@
+package gobt
+
+import "sync"
+
+// MemoryBudget caps the amount of piece data that is buffered in memory
+// before it is verified and written out. Limit of 0 means unlimited.
+type MemoryBudget struct {
+	limit int
+	used  int
+	// released is closed and replaced whenever memory is released
+	released chan struct{}
+
+	sync.Mutex
+}
+
+func NewMemoryBudget(limit int) *MemoryBudget {
+	return &MemoryBudget{limit: limit, released: make(chan struct{})}
+}
+
+// Reserve accounts n bytes if they fit into the budget. A single reservation
+// is always allowed on an empty budget so pieces larger than limit can
+// still be downloaded.
+func (b *MemoryBudget) Reserve(n int) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.limit > 0 && b.used > 0 && b.used+n > b.limit {
+		return false
+	}
+
+	b.used += n
+	return true
+}
+
+func (b *MemoryBudget) Release(n int) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.used -= n
+	if b.used < 0 {
+		b.used = 0
+	}
+
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// Released returns channel that is closed once memory is next released, so
+// pieces that did not fit into budget can be started.
+func (b *MemoryBudget) Released() <-chan struct{} {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.released
+}
+
+// Used returns the number of bytes currently reserved.
+func (b *MemoryBudget) Used() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.used
+}
+
+func (b *MemoryBudget) Limit() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.limit
+}
+
+// SetLimit changes the limit, pieces that are already reserved are kept.
+func (b *MemoryBudget) SetLimit(limit int) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.limit = limit
+}
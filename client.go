@@ -1,17 +1,33 @@
 package gobt
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 
 	bencode "github.com/jackpal/bencode-go"
 )
 
-const DefaultListenPort = 6881
+const (
+	DefaultListenPort = 6881
+	// Unverified piece data kept in memory by all torrents of client
+	DefaultMemoryLimit = 256 << 20
+)
+
+var (
+	// ErrTorrentExists is returned when adding torrent that client already
+	// has.
+	ErrTorrentExists = errors.New("torrent already added")
+	// ErrClientClosed is returned when adding torrent to closed client.
+	ErrClientClosed = errors.New("client closed")
+)
 
 func GenRandPeerID() ([20]byte, error) {
 	b := [20]byte{}
@@ -20,8 +36,322 @@ func GenRandPeerID() ([20]byte, error) {
 	return b, err
 }
 
+// Client is session of many torrents downloaded into directory. Torrents
+// share peer ID, listen port, connection and bandwidth limits, memory budget
+// for unverified pieces and pool of disk workers.
+type Client struct {
+	dir      string
+	peerID   [20]byte
+	dial     func(addr string) (net.Conn, error)
+	port     int
+	listener net.Listener
+
+	budget      *MemoryBudget
+	limit       *BandwidthLimit
+	conns       *ConnLimit
+	disk        *diskPool
+	peerDown    int
+	peerUp      int
+	exemptLocal bool
+
+	logger *slog.Logger
+	levels map[string]*slog.LevelVar
+
+	torrents map[[HashSize]byte]*Torrent
+	events   *eventBus
+	closed   bool
+
+	sync.Mutex
+}
+
+// NewClient creates client which stores downloaded files in dir.
+func NewClient(dir string) (*Client, error) {
+	peerID, err := GenRandPeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	levels := map[string]*slog.LevelVar{}
+	for _, subsystem := range logSubsystems {
+		levels[subsystem] = &slog.LevelVar{}
+	}
+
+	return &Client{
+		dir:         dir,
+		peerID:      peerID,
+		dial:        dialTimeout,
+		port:        DefaultListenPort,
+		budget:      NewMemoryBudget(DefaultMemoryLimit),
+		limit:       NewBandwidthLimit(0, 0),
+		conns:       NewConnLimit(DefaultMaxClientConns, DefaultMaxClientHalfOpen),
+		disk:        newDiskPool(DefaultDiskWorkers),
+		exemptLocal: true,
+		torrents:    map[[HashSize]byte]*Torrent{},
+		events:      newEventBus(),
+		logger:      slog.Default(),
+		levels:      levels,
+	}, nil
+}
+
+func (c *Client) PeerID() [20]byte {
+	return c.peerID
+}
+
+// SetDialer sets function used to connect to peers of torrents started
+// from now on.
+func (c *Client) SetDialer(dial func(addr string) (net.Conn, error)) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.dial = dial
+}
+
+func (c *Client) dialer() func(addr string) (net.Conn, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.dial
+}
+
+// SetMemoryLimit sets bytes of unverified piece data kept in memory, 0 for
+// unlimited.
+func (c *Client) SetMemoryLimit(limit int) {
+	c.budget.SetLimit(limit)
+}
+
+// MemoryUsage returns bytes of unverified piece data reserved by all
+// torrents and the limit, 0 for unlimited.
+func (c *Client) MemoryUsage() (int, int) {
+	return c.budget.Used(), c.budget.Limit()
+}
+
+// Limit returns bandwidth limit shared by all torrents.
+func (c *Client) Limit() *BandwidthLimit {
+	return c.limit
+}
+
+// SetPeerLimit sets download and upload limit of every peer.
+func (c *Client) SetPeerLimit(download, upload int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.peerDown, c.peerUp = download, upload
+	for _, t := range c.torrents {
+		t.peers.SetPeerLimit(download, upload)
+	}
+}
+
+// SetExemptLocal makes peers on local network bypass all bandwidth limits.
+func (c *Client) SetExemptLocal(exempt bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.exemptLocal = exempt
+	for _, t := range c.torrents {
+		t.peers.SetExemptLocal(exempt)
+	}
+}
+
+// ConnLimit returns connection limit shared by all torrents.
+func (c *Client) ConnLimit() *ConnLimit {
+	return c.conns
+}
+
+// Listen accepts connections of peers on addr for all torrents. Port of
+// listener is announced to trackers of torrents started from now on.
+func (c *Client) Listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.listener = ln
+	c.port = ln.Addr().(*net.TCPAddr).Port
+	c.Unlock()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go c.accept(conn)
+		}
+	}()
+
+	return nil
+}
+
+// Port returns port announced to trackers.
+func (c *Client) Port() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.port
+}
+
+// accept hands incoming connection to torrent peer asks for.
+func (c *Client) accept(conn net.Conn) {
+	if !c.conns.accept() {
+		conn.Close()
+		return
+	}
+	defer c.conns.closed()
+
+	peer := NewPeer(conn)
+	defer peer.Close()
+
+	peer.SetReadDeadline(MaxPeerTimeout)
+	var t *Torrent
+	_, err := peer.AcceptHandshake(c.peerID, func(hash [20]byte) bool {
+		t = c.Torrent(hash)
+		return t != nil
+	})
+	if err != nil {
+		c.log(LogWire).Debug("handshake failed", "peer", peer.String(), "err", err)
+		return
+	}
+
+	t.accept(peer)
+}
+
+// AddTorrent adds torrent of metainfo. Torrent is not started.
+func (c *Client) AddTorrent(m *Metainfo) (*Torrent, error) {
+	t, err := newTorrent(c, m)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+
+	if _, ok := c.torrents[t.hash]; ok {
+		return nil, ErrTorrentExists
+	}
+
+	t.peers.SetGlobalLimit(c.limit)
+	t.peers.SetPeerLimit(c.peerDown, c.peerUp)
+	t.peers.SetExemptLocal(c.exemptLocal)
+	c.torrents[t.hash] = t
+
+	return t, nil
+}
+
+// SetLogger sets logger that client and its torrents log to, each
+// subsystem with its own level. It should be set before torrents are added.
+func (c *Client) SetLogger(logger *slog.Logger) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.logger = logger
+}
+
+// SetLogLevel sets level of subsystem, one of LogTracker, LogWire,
+// LogPicker or LogStorage. Level of all subsystems is info by default, and
+// LevelTrace for wire logs every message.
+func (c *Client) SetLogLevel(subsystem string, level slog.Level) {
+	if v, ok := c.levels[subsystem]; ok {
+		v.Set(level)
+	}
+}
+
+// log returns logger of subsystem.
+func (c *Client) log(subsystem string) *slog.Logger {
+	c.Lock()
+	logger := c.logger
+	c.Unlock()
+
+	return slog.New(&levelHandler{level: c.levels[subsystem], handler: logger.Handler()}).With("subsystem", subsystem)
+}
+
+// MetricsHandler returns handler serving metrics of client and its torrents
+// in Prometheus text format.
+func (c *Client) MetricsHandler() *MetricsHandler {
+	return NewMetricsHandler(c)
+}
+
+// Subscribe returns subscription to events of all torrents with room for
+// buffer events.
+func (c *Client) Subscribe(buffer int) *Subscription {
+	return c.events.subscribe(buffer, nil)
+}
+
+// OnEvent calls fn with every event of all torrents. Calls are made from
+// goroutine of subscription, one at a time, and never block torrents.
+func (c *Client) OnEvent(fn func(e Event)) *Subscription {
+	return c.events.onEvent(fn, nil)
+}
+
+// Torrent returns torrent with info hash, or nil if client does not have it.
+func (c *Client) Torrent(hash [HashSize]byte) *Torrent {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.torrents[hash]
+}
+
+// Torrents returns all torrents of client.
+func (c *Client) Torrents() []*Torrent {
+	c.Lock()
+	defer c.Unlock()
+
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+
+	return torrents
+}
+
+// Close stops listening, stops every torrent and closes its files.
+func (c *Client) Close() error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil
+	}
+
+	c.closed = true
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	c.Unlock()
+
+	var err error
+	for _, t := range c.Torrents() {
+		if cerr := t.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+
+	c.disk.close()
+	c.events.close()
+	return err
+}
+
+func (c *Client) remove(t *Torrent) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.torrents, t.hash)
+}
+
+// AnnounceStats is transfer progress of torrent reported to tracker.
+type AnnounceStats struct {
+	Uploaded   int64
+	Downloaded int64
+	// Bytes of content not verified yet
+	Left int64
+}
+
 type AnnounceResponse struct {
-	Failure  string         `bencode:"failure"`
+	Failure  string         `bencode:"failure reason,omitempty"`
 	Interval int            `bencode:"interval"`
 	Peers    []AnnouncePeer `bencode:"peers"`
 }
@@ -36,7 +366,7 @@ func (ap *AnnouncePeer) Addr() string {
 	return net.JoinHostPort(ap.IP, strconv.Itoa(ap.Port))
 }
 
-func buildRequestURL(uri string, hash [20]byte, peerID [20]byte, length int, port int) (*url.URL, error) {
+func buildRequestURL(uri string, hash [20]byte, peerID [20]byte, stats AnnounceStats, port int) (*url.URL, error) {
 	parsed, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
@@ -46,23 +376,39 @@ func buildRequestURL(uri string, hash [20]byte, peerID [20]byte, length int, por
 	query.Set("info_hash", string(hash[:]))
 	query.Set("peer_id", string(peerID[:]))
 	query.Set("port", strconv.Itoa(port))
-	query.Set("uploaded", strconv.Itoa(0))
-	query.Set("downloaded", strconv.Itoa(0))
-	query.Set("left", strconv.Itoa(length))
+	query.Set("uploaded", strconv.FormatInt(stats.Uploaded, 10))
+	query.Set("downloaded", strconv.FormatInt(stats.Downloaded, 10))
+	query.Set("left", strconv.FormatInt(stats.Left, 10))
 
 	parsed.RawQuery = query.Encode()
 
 	return parsed, nil
 }
 
-func GetAvailablePeers(uri string, hash [20]byte, peerID [20]byte, length int) ([]AnnouncePeer, error) {
-	annUri, err := buildRequestURL(uri, hash, peerID, length, DefaultListenPort)
-	fmt.Println(annUri.String())
+func GetAvailablePeers(uri string, hash [20]byte, peerID [20]byte, length int64, port int) ([]AnnouncePeer, error) {
+	ann, err := Announce(context.Background(), uri, hash, peerID, AnnounceStats{Left: length}, port)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := http.Get(annUri.String())
+	return ann.Peers, nil
+}
+
+// Announce requests peers of torrent from tracker at uri. Request is
+// cancelled with ctx. Error is returned when tracker responds with status
+// other than 200 or with failure reason.
+func Announce(ctx context.Context, uri string, hash [20]byte, peerID [20]byte, stats AnnounceStats, port int) (*AnnounceResponse, error) {
+	annUri, err := buildRequestURL(uri, hash, peerID, stats, port)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, annUri.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -70,11 +416,19 @@ func GetAvailablePeers(uri string, hash [20]byte, peerID [20]byte, length int) (
 		return nil, err
 	}
 
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker responded with status %s", res.Status)
+	}
+
 	ann := &AnnounceResponse{}
 	err = bencode.Unmarshal(res.Body, ann)
 	if err != nil {
 		return nil, err
 	}
 
-	return ann.Peers, nil
+	if ann.Failure != "" {
+		return nil, fmt.Errorf("tracker failure: %s", ann.Failure)
+	}
+
+	return ann, nil
 }
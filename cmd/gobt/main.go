@@ -1,28 +1,61 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"math"
-	"net"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/edwces/gobt"
-	"github.com/edwces/gobt/bitfield"
-	"github.com/edwces/gobt/protocol"
+	"golang.org/x/exp/slices"
 )
 
-const (
-	MaxPeerTimeout     = 2*time.Minute + 10*time.Second
-	KeepAlivePeriod    = 1*time.Minute + 30*time.Second
-	DefaultConnTimeout = 3 * time.Second
+var (
+	memoryLimit = flag.Int("memory", gobt.DefaultMemoryLimit, "maximum bytes of unverified piece data kept in memory, 0 for unlimited")
+	sequential  = flag.Bool("sequential", false, "download pieces in order")
+	only        = flag.String("only", "", "download only files with path prefix")
+
+	downloadLimit     = flag.Int("download-limit", 0, "maximum download bytes per second, 0 for unlimited")
+	uploadLimit       = flag.Int("upload-limit", 0, "maximum upload bytes per second, 0 for unlimited")
+	peerDownloadLimit = flag.Int("peer-download-limit", 0, "maximum download bytes per second from each peer, 0 for unlimited")
+	peerUploadLimit   = flag.Int("peer-upload-limit", 0, "maximum upload bytes per second to each peer, 0 for unlimited")
+	limitLocal        = flag.Bool("limit-local", false, "apply bandwidth limits to peers on local network")
+	schedulePath      = flag.String("schedule", "", "file with time of day bandwidth limits, reloaded on SIGHUP")
+
+	maxConns    = flag.Int("max-conns", gobt.DefaultMaxConns, "maximum number of connected peers")
+	maxHalfOpen = flag.Int("max-half-open", gobt.DefaultMaxHalfOpen, "maximum number of connections being dialed at once")
+	listen      = flag.String("listen", fmt.Sprintf(":%d", gobt.DefaultListenPort), "address to accept peer connections on, empty to not accept")
+
+	metricsAddr = flag.String("metrics", "", "HTTP address to serve Prometheus metrics on, empty to not serve")
+	logLevel    = flag.String("log-level", "info", "log level of all subsystems, followed by subsystem=level overrides, such as info,wire=trace,tracker=debug")
 )
 
 func main() {
-	path := os.Args[1]
+	flag.Parse()
+	args := flag.Args()
+
+	// Serve mode exposes content over HTTP while downloading
+	serve := len(args) > 0 && args[0] == "serve"
+	serveFlags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := serveFlags.String("addr", ":8080", "HTTP listen address")
+
+	if serve {
+		serveFlags.Parse(args[1:])
+		args = serveFlags.Args()
+	}
+
+	if len(args) == 0 {
+		fmt.Println("usage: gobt [-memory bytes] [-sequential] [-only prefix] [-download-limit rate] [-upload-limit rate] [-peer-download-limit rate] [-peer-upload-limit rate] [-limit-local] [-schedule file] [-max-conns n] [-max-half-open n] [-listen address] [-log-level levels] [-metrics address] [serve [-addr address]] file.torrent")
+		return
+	}
+	path := args[0]
 
 	// Open file
 	metainfoFile, err := os.Open(path)
@@ -38,254 +71,186 @@ func main() {
 	}
 	metainfoFile.Close()
 
-	clientID, err := gobt.GenRandPeerID()
+	client, err := gobt.NewClient(".")
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	hash, err := metainfo.InfoHash()
+	levels, err := parseLogLevels(*logLevel)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	// Receive the peers from tracker
-	peers, err := gobt.GetAvailablePeers(metainfo.Announce, hash, clientID, metainfo.Info.Length)
-	if err != nil {
-		fmt.Println(err)
-		return
+	// Subsystem levels filter records, so handler passes everything
+	client.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: gobt.LevelTrace})))
+	for subsystem, level := range levels {
+		client.SetLogLevel(subsystem, level)
 	}
 
-	hashes, err := metainfo.PieceHashes()
-	if err != nil {
-		fmt.Println(err)
-		return
+	client.SetMemoryLimit(*memoryLimit)
+	client.Limit().SetLimit(*downloadLimit, *uploadLimit)
+	client.SetPeerLimit(*peerDownloadLimit, *peerUploadLimit)
+	client.SetExemptLocal(!*limitLocal)
+
+	if *listen != "" {
+		// Download still works without incoming connections
+		err := client.Listen(*listen)
+		if err != nil {
+			fmt.Println(err)
+		}
 	}
 
-	pp := gobt.NewPicker(metainfo.Info.Length, metainfo.Info.PieceLength)
-	storage := gobt.NewStorage(metainfo.Info.Length, metainfo.Info.PieceLength)
-	clientBf := bitfield.New(len(hashes))
-	connected := gobt.NewPeersManager()
-	pCount := 0
-
-	file, err := os.Create(metainfo.Info.Name)
+	t, err := client.AddTorrent(metainfo)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	t.SetSequential(*sequential)
+	t.SetMaxConns(*maxConns)
+	t.SetMaxHalfOpen(*maxHalfOpen)
+	for i, entry := range t.Files() {
+		if !strings.HasPrefix(filepath.ToSlash(entry.Path), *only) {
+			t.SetFilePriority(i, gobt.PrioritySkip)
+		}
+	}
 
-	go func() {
-		<-c
-		connected.Disconnect()
-	}()
+	// Print progress as pieces arrive
+	client.OnEvent(func(e gobt.Event) {
+		switch e.Type {
+		case gobt.EventPieceVerified:
+			done, wanted := t.Progress()
+			fmt.Printf("%s GOT PIECE: %d; [%d / %d] %.1f KiB/s\n", e.Peer, e.Piece, done, wanted, t.Stats().DownloadRate/1024)
+		case gobt.EventFileCompleted:
+			fmt.Printf("COMPLETED: %s\n", t.Files()[e.File].Path)
+		}
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *schedulePath != "" {
+		schedule, err := loadSchedule(*schedulePath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		scheduler := gobt.NewScheduler(client.Limit(), schedule)
+		go scheduler.Run(ctx.Done())
+
+		// Reload schedule without restarting download
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		go func() {
+			for range hup {
+				schedule, err := loadSchedule(*schedulePath)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
 
-	var wg sync.WaitGroup
+				scheduler.SetSchedule(schedule)
+			}
+		}()
+	}
 
-	for _, peer := range peers {
-		wg.Add(1)
-		go func(announcePeer gobt.AnnouncePeer) {
-			conn, err := net.DialTimeout("tcp", announcePeer.Addr(), DefaultConnTimeout)
+	if *metricsAddr != "" {
+		go func() {
+			err := http.ListenAndServe(*metricsAddr, client.MetricsHandler())
 			if err != nil {
-				fmt.Printf("connection error: %v\n", err)
-				wg.Done()
-				return
+				fmt.Println(err)
 			}
-			peer := gobt.NewPeer(conn)
-			defer peer.Close()
+		}()
+	}
 
-			err = peer.Handshake(hash, clientID)
+	if serve {
+		go func() {
+			err := http.ListenAndServe(*addr, t.Handler())
 			if err != nil {
-				fmt.Printf("handshake error: %v\n", err)
-				wg.Done()
-				return
+				fmt.Println(err)
 			}
+		}()
+	}
 
-			connected.Add(peer)
-
-			// Message loop
-			bf := bitfield.New(len(hashes))
+	err = t.Start(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-			defer func() {
-				for _, req := range peer.Requests {
-					pp.FailPendingBlock(req[0], req[1], peer.String())
-				}
-				pp.DecrementAvailability(bf)
-				connected.Remove(peer)
-				wg.Done()
-			}()
+	err = t.Wait(ctx)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Println(err)
+	}
 
-			peer.KeepAlive(KeepAlivePeriod)
+	// Keep serving downloaded content until interrupted
+	if serve && err == nil {
+		<-ctx.Done()
+	}
 
-			for {
-				peer.SetReadDeadline(MaxPeerTimeout)
-				msg, err := peer.ReadMsg()
+	if err != nil {
+		t.Remove()
+	}
+	client.Close()
+}
 
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
+// parseLogLevels parses level of all subsystems followed by overrides of
+// single subsystems, such as "info,wire=trace".
+func parseLogLevels(s string) (map[string]slog.Level, error) {
+	subsystems := []string{gobt.LogTracker, gobt.LogWire, gobt.LogPicker, gobt.LogStorage}
+	levels := map[string]slog.Level{}
+
+	for i, field := range strings.Split(s, ",") {
+		subsystem, name, ok := strings.Cut(field, "=")
+		if !ok {
+			if i != 0 {
+				return nil, fmt.Errorf("log level %q: expected subsystem=level", field)
+			}
+			name = subsystem
+		}
 
-				if msg.KeepAlive {
-					continue
-				}
+		level, err := parseLevel(name)
+		if err != nil {
+			return nil, err
+		}
 
-				switch msg.ID {
-				case protocol.IDChoke:
-					peer.IsChoking = true
-				case protocol.IDPiece:
-					block := msg.Payload.Block()
-
-					err := peer.RecvRequest(int(block.Index), int(block.Offset), len(block.Block))
-					if err != nil {
-						fmt.Printf("invalid block received: %v\n", err)
-						return
-					}
-
-					pp.MarkBlockDone(int(block.Index), int(block.Offset)/gobt.MaxBlockLength, peer.String())
-					if pp.IsBlockDownloaded(int(block.Index), int(block.Offset)/gobt.MaxBlockLength) {
-						connected.WriteCancel(int(block.Index), int(block.Offset), len(block.Block), peer.String())
-					}
-
-					// Store piece
-					storage.SaveAt(int(block.Index), block.Block, int(block.Offset))
-
-					if pp.IsPieceDone(int(block.Index)) {
-						if storage.Verify(int(block.Index), hashes[block.Index]) {
-							pCount++
-							clientBf.Set(int(block.Index))
-							fmt.Printf("%s GOT PIECE: %d; [%d / %d] \n", announcePeer.Addr(), block.Index, pCount, len(hashes))
-							file.WriteAt(storage.GetPieceData(int(block.Index)), int64(int(block.Index)*metainfo.Info.PieceLength))
-
-							connected.WriteHave(int(block.Index), peer.String())
-
-							if clientBf.Full() {
-								connected.Disconnect()
-							}
-						} else {
-							pp.FailPendingPiece(int(block.Index))
-							peer.HashFails += 1
-							if peer.HashFails >= gobt.MaxHashFails {
-								fmt.Println("Excedded Maximum hash fails: 5")
-								return
-							}
-						}
-					}
-
-					for peer.IsRequestable() {
-						// Send request
-						cp, cb, err := pp.Pick(bf, peer.String())
-
-						if err != nil {
-							err := peer.SendNotInterested()
-							if err != nil {
-								fmt.Println(err)
-								return
-							}
-							break
-						}
-
-						length := int(math.Min(float64(gobt.MaxBlockLength), float64(metainfo.Info.PieceLength)-float64(cb*gobt.MaxBlockLength)))
-						err = peer.SendRequest(cp, cb*gobt.MaxBlockLength, length)
-						if err != nil {
-							fmt.Println(err)
-							return
-						}
-					}
-
-				case protocol.IDUnchoke:
-
-					unresolved := [][]int{}
-					if peer.IsChoking {
-						unresolved = peer.Requests
-						peer.Requests = [][]int{}
-					}
-
-					for peer.IsRequestable() {
-						// Pick block to request
-						var cp, cb int
-
-						if len(unresolved) == 0 {
-							cp, cb, err = pp.Pick(bf, peer.String())
-
-							if err != nil {
-								err := peer.SendNotInterested()
-								if err != nil {
-									fmt.Println(err)
-									return
-								}
-								break
-							}
-						} else {
-							cp = unresolved[0][0]
-							cb = unresolved[0][1]
-							unresolved = unresolved[1:]
-						}
-
-						length := int(math.Min(float64(gobt.MaxBlockLength), float64(metainfo.Info.PieceLength)-float64(cb*gobt.MaxBlockLength)))
-						err = peer.SendRequest(cp, cb*gobt.MaxBlockLength, length)
-						if err != nil {
-							fmt.Println(err)
-							return
-						}
-					}
-
-					peer.IsChoking = false
-				case protocol.IDHave:
-					have := int(msg.Payload.Have())
-					err := bf.Set(have)
-
-					if err != nil {
-						fmt.Printf("Bitfield: %v\n", err)
-						return
-					}
-
-					pp.IncrementPieceAvailability(have)
-
-					if has, _ := clientBf.Get(have); !peer.IsInteresting && !has {
-						err := peer.SendInterested()
-						if err != nil {
-							fmt.Println(err)
-							return
-						}
-					}
-				case protocol.IDBitfield:
-					// Define peer bitfield
-					err := bf.Replace(msg.Payload)
-					if err != nil {
-						fmt.Printf("Bitfield: %v\n", err)
-						return
-					}
-
-					pp.IncrementAvailability(bf)
-
-					// Calculate interesting pieces that peer has
-					diff, err := bf.Difference(clientBf)
-					if err != nil {
-						fmt.Printf("Bitfield: %v\n", err)
-						return
-					}
-
-					// Send interest status if it's not empty
-					if !diff.Empty() {
-						err := peer.SendInterested()
-						if err != nil {
-							fmt.Println(err)
-							return
-						}
-					}
-					// conn.WriteUnchoke()
-				}
+		if !ok {
+			for _, subsystem := range subsystems {
+				levels[subsystem] = level
 			}
-		}(peer)
+			continue
+		}
+
+		if !slices.Contains(subsystems, subsystem) {
+			return nil, fmt.Errorf("log level %q: unknown subsystem %q", field, subsystem)
+		}
+		levels[subsystem] = level
 	}
 
-	wg.Wait()
-	file.Close()
-	if !clientBf.Full() {
-		os.Remove(metainfo.Info.Name)
+	return levels, nil
+}
+
+func parseLevel(name string) (slog.Level, error) {
+	if strings.EqualFold(name, "trace") {
+		return gobt.LevelTrace, nil
 	}
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+func loadSchedule(path string) (*gobt.Schedule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Flag limits apply outside scheduled rules, unless file sets default
+	return gobt.ParseScheduleDefault(f, *downloadLimit, *uploadLimit)
 }
@@ -0,0 +1,525 @@
+package gobt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxConns    = 50
+	DefaultMaxHalfOpen = 8
+
+	// Limits shared by all torrents of client
+	DefaultMaxClientConns    = 500
+	DefaultMaxClientHalfOpen = 32
+
+	// Backoff after first failure, doubled with every further failure
+	MinReconnectBackoff = 10 * time.Second
+	MaxReconnectBackoff = 30 * time.Minute
+	// Candidate is dropped after this many failures in a row
+	MaxConnFailures = 8
+	// Session shorter than this counts as failure
+	MinSessionDuration = time.Minute
+
+	// How often the slowest peer is replaced when connections are full
+	ReplacePeriod = 2 * time.Minute
+	// How often candidates waiting for backoff are rechecked
+	ConnCheckPeriod = time.Second
+)
+
+// ConnLimit limits connections shared by connection managers of all
+// torrents and incoming connections. Limit of 0 means unlimited. Nil
+// ConnLimit allows everything.
+type ConnLimit struct {
+	maxConns    int
+	maxHalfOpen int
+	conns       int
+	halfOpen    int
+
+	sync.Mutex
+}
+
+func NewConnLimit(maxConns, maxHalfOpen int) *ConnLimit {
+	return &ConnLimit{maxConns: maxConns, maxHalfOpen: maxHalfOpen}
+}
+
+func (l *ConnLimit) SetLimit(maxConns, maxHalfOpen int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.maxConns, l.maxHalfOpen = maxConns, maxHalfOpen
+}
+
+// Conns returns number of connected peers and dials in progress.
+func (l *ConnLimit) Conns() (int, int) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.conns, l.halfOpen
+}
+
+// dial reserves slot for outgoing connection if there is one.
+func (l *ConnLimit) dial() bool {
+	if l == nil {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.isFull() || l.maxHalfOpen > 0 && l.halfOpen >= l.maxHalfOpen {
+		return false
+	}
+
+	l.halfOpen++
+	return true
+}
+
+// dialed turns reserved dial into connection, or frees its slot if dial
+// failed.
+func (l *ConnLimit) dialed(connected bool) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.halfOpen--
+	if connected {
+		l.conns++
+	}
+}
+
+// accept reserves slot for incoming connection if there is one.
+func (l *ConnLimit) accept() bool {
+	if l == nil {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.isFull() {
+		return false
+	}
+
+	l.conns++
+	return true
+}
+
+// closed frees slot of connection.
+func (l *ConnLimit) closed() {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.conns--
+}
+
+func (l *ConnLimit) isFull() bool {
+	return l.maxConns > 0 && l.conns+l.halfOpen >= l.maxConns
+}
+
+type candidateState int
+
+const (
+	candidateIdle candidateState = iota
+	candidateDialing
+	candidateConnected
+)
+
+type candidate struct {
+	addr     string
+	priority uint32
+	state    candidateState
+
+	failures  int
+	retryAt   time.Time
+	connected time.Time
+	replaced  bool
+	peer      *Peer
+}
+
+// ConnManager keeps pool of candidate peers from every discovery source and
+// connects to them, keeping at most max connections and max half-open dials.
+// Candidates are tried by canonical peer priority (BEP 40), failed ones are
+// retried with exponential backoff, and the slowest peer is periodically
+// replaced by a new candidate.
+type ConnManager struct {
+	dial   func(addr string) (net.Conn, error)
+	handle func(peer *Peer)
+
+	candidates  map[string]*candidate
+	halfOpen    int
+	conns       int
+	maxConns    int
+	maxHalfOpen int
+	localIP     net.IP
+	localPort   int
+	shared      *ConnLimit
+	// stopped is set once Run stops, so dials that finish later are closed
+	stopped bool
+
+	wake chan struct{}
+	wg   sync.WaitGroup
+
+	sync.Mutex
+}
+
+// NewConnManager creates manager which dials candidates with dial and runs
+// handle for each connected peer. Connection is closed once handle returns.
+func NewConnManager(dial func(addr string) (net.Conn, error), handle func(peer *Peer)) *ConnManager {
+	return &ConnManager{
+		dial:        dial,
+		handle:      handle,
+		candidates:  map[string]*candidate{},
+		maxConns:    DefaultMaxConns,
+		maxHalfOpen: DefaultMaxHalfOpen,
+		localPort:   DefaultListenPort,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func (cm *ConnManager) SetMaxConns(n int) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	cm.maxConns = n
+	cm.notify()
+}
+
+func (cm *ConnManager) SetMaxHalfOpen(n int) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	cm.maxHalfOpen = n
+	cm.notify()
+}
+
+// SetSharedLimit sets connection limit shared with other managers. It must
+// be set before Run.
+func (cm *ConnManager) SetSharedLimit(limit *ConnLimit) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	cm.shared = limit
+}
+
+// SetLocalPort sets port that peers can connect to, used for candidate
+// priority.
+func (cm *ConnManager) SetLocalPort(port int) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	cm.localPort = port
+	for _, c := range cm.candidates {
+		c.priority = cm.priority(c.addr)
+	}
+}
+
+// SetLocalIP sets external address used for candidate priority. Until it is
+// set, local address of the first connection is used.
+func (cm *ConnManager) SetLocalIP(ip net.IP) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	cm.setLocalIP(ip)
+}
+
+func (cm *ConnManager) setLocalIP(ip net.IP) {
+	cm.localIP = ip
+	for _, c := range cm.candidates {
+		c.priority = cm.priority(c.addr)
+	}
+}
+
+// Add adds candidate addresses. Known addresses are ignored.
+func (cm *ConnManager) Add(addrs ...string) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	for _, addr := range addrs {
+		if _, ok := cm.candidates[addr]; ok {
+			continue
+		}
+
+		cm.candidates[addr] = &candidate{addr: addr, priority: cm.priority(addr)}
+	}
+
+	cm.notify()
+}
+
+// Conns returns number of connected peers and dials in progress.
+func (cm *ConnManager) Conns() (int, int) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	return cm.conns, cm.halfOpen
+}
+
+// Run connects to candidates until stop is closed, then closes every
+// connection and waits for handlers to return.
+func (cm *ConnManager) Run(stop <-chan struct{}) {
+	cm.Lock()
+	cm.stopped = false
+	cm.Unlock()
+
+	check := time.NewTicker(ConnCheckPeriod)
+	defer check.Stop()
+	replace := time.NewTicker(ReplacePeriod)
+	defer replace.Stop()
+
+	for {
+		cm.fill(time.Now())
+
+		select {
+		case <-stop:
+			cm.closeAll()
+			cm.wg.Wait()
+			return
+		case <-cm.wake:
+		case <-check.C:
+		case now := <-replace.C:
+			cm.replaceSlowest(now)
+		}
+	}
+}
+
+func (cm *ConnManager) notify() {
+	select {
+	case cm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fill dials best candidates while there are free connection slots.
+func (cm *ConnManager) fill(now time.Time) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	for cm.conns+cm.halfOpen < cm.maxConns && cm.halfOpen < cm.maxHalfOpen {
+		c := cm.best(now)
+		if c == nil || !cm.shared.dial() {
+			return
+		}
+
+		c.state = candidateDialing
+		cm.halfOpen++
+		cm.wg.Add(1)
+		go cm.connect(c)
+	}
+}
+
+// best returns idle candidate with the highest priority that is not
+// waiting for backoff.
+func (cm *ConnManager) best(now time.Time) *candidate {
+	var best *candidate
+
+	for _, c := range cm.candidates {
+		if c.state != candidateIdle || now.Before(c.retryAt) {
+			continue
+		}
+
+		if best == nil || c.priority > best.priority || c.priority == best.priority && c.addr < best.addr {
+			best = c
+		}
+	}
+
+	return best
+}
+
+func (cm *ConnManager) connect(c *candidate) {
+	defer cm.wg.Done()
+
+	conn, err := cm.dial(c.addr)
+
+	cm.Lock()
+	cm.halfOpen--
+	cm.shared.dialed(err == nil && !cm.stopped)
+	if err != nil {
+		cm.fail(c, time.Now())
+		cm.notify()
+		cm.Unlock()
+		return
+	}
+
+	if cm.stopped {
+		c.state = candidateIdle
+		cm.Unlock()
+		conn.Close()
+		return
+	}
+
+	peer := NewPeer(conn)
+	c.state = candidateConnected
+	c.connected = time.Now()
+	c.peer = peer
+	cm.conns++
+
+	if cm.localIP == nil {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			cm.setLocalIP(addr.IP)
+		}
+	}
+	cm.Unlock()
+
+	cm.handle(peer)
+	peer.Close()
+
+	cm.Lock()
+	defer cm.Unlock()
+
+	now := time.Now()
+	cm.conns--
+	cm.shared.closed()
+	c.peer = nil
+
+	if c.replaced || now.Sub(c.connected) < MinSessionDuration {
+		c.replaced = false
+		cm.fail(c, now)
+	} else {
+		c.state = candidateIdle
+		c.failures = 0
+		c.retryAt = now.Add(MinReconnectBackoff)
+	}
+
+	cm.notify()
+}
+
+// fail puts candidate back to pool with backoff, or drops it after too many
+// failures.
+func (cm *ConnManager) fail(c *candidate, now time.Time) {
+	c.failures++
+	if c.failures >= MaxConnFailures {
+		delete(cm.candidates, c.addr)
+		return
+	}
+
+	backoff := MinReconnectBackoff << (c.failures - 1)
+	if backoff > MaxReconnectBackoff {
+		backoff = MaxReconnectBackoff
+	}
+
+	c.state = candidateIdle
+	c.retryAt = now.Add(backoff)
+}
+
+// replaceSlowest closes the slowest peer connected for at least
+// ReplacePeriod if connections are full and another candidate is waiting.
+func (cm *ConnManager) replaceSlowest(now time.Time) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	if cm.conns < cm.maxConns || cm.best(now) == nil {
+		return
+	}
+
+	var slowest *candidate
+	slowestRate := 0.0
+
+	for _, c := range cm.candidates {
+		if c.state != candidateConnected || now.Sub(c.connected) < ReplacePeriod {
+			continue
+		}
+
+		rate := c.peer.Stats().DownloadRate
+		if slowest == nil || rate < slowestRate {
+			slowest = c
+			slowestRate = rate
+		}
+	}
+
+	if slowest != nil {
+		slowest.replaced = true
+		slowest.peer.Close()
+	}
+}
+
+func (cm *ConnManager) closeAll() {
+	cm.Lock()
+	defer cm.Unlock()
+
+	cm.stopped = true
+	for _, c := range cm.candidates {
+		if c.peer != nil {
+			c.peer.Close()
+		}
+	}
+}
+
+func (cm *ConnManager) priority(addr string) uint32 {
+	if cm.localIP == nil {
+		return 0
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return 0
+	}
+
+	return CanonicalPriority(&net.TCPAddr{IP: cm.localIP, Port: cm.localPort}, &net.TCPAddr{IP: ip, Port: p})
+}
+
+// CanonicalPriority returns priority of connection between two peers as
+// defined by BEP 40. Both peers compute the same priority, so peers prefer
+// the same connections. IPv6 addresses are masked after the first 48 bits.
+func CanonicalPriority(a, b *net.TCPAddr) uint32 {
+	table := crc32.MakeTable(crc32.Castagnoli)
+
+	if a.IP.Equal(b.IP) {
+		ports := []uint16{uint16(a.Port), uint16(b.Port)}
+		if ports[0] > ports[1] {
+			ports[0], ports[1] = ports[1], ports[0]
+		}
+
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint16(buf, ports[0])
+		binary.BigEndian.PutUint16(buf[2:], ports[1])
+		return crc32.Checksum(buf, table)
+	}
+
+	ipA, ipB := a.IP.To4(), b.IP.To4()
+	var mask []byte
+
+	if ipA != nil && ipB != nil {
+		switch {
+		case bytes.Equal(ipA[:3], ipB[:3]):
+			mask = []byte{0xff, 0xff, 0xff, 0xff}
+		case bytes.Equal(ipA[:2], ipB[:2]):
+			mask = []byte{0xff, 0xff, 0xff, 0x55}
+		default:
+			mask = []byte{0xff, 0xff, 0x55, 0x55}
+		}
+	} else {
+		ipA, ipB = a.IP.To16(), b.IP.To16()
+		mask = bytes.Repeat([]byte{0x55}, net.IPv6len)
+		copy(mask, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+
+	maskedA, maskedB := make([]byte, len(mask)), make([]byte, len(mask))
+	for i := range mask {
+		maskedA[i] = ipA[i] & mask[i]
+		maskedB[i] = ipB[i] & mask[i]
+	}
+
+	if bytes.Compare(maskedA, maskedB) > 0 {
+		maskedA, maskedB = maskedB, maskedA
+	}
+
+	return crc32.Checksum(append(maskedA, maskedB...), table)
+}
@@ -0,0 +1,267 @@
+package gobt_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/edwces/gobt"
+)
+
+func TestCanonicalPriority(t *testing.T) {
+	// Examples from BEP 40
+	tests := map[string]struct {
+		a, b string
+		want uint32
+	}{
+		"different networks": {a: "123.213.32.10:6881", b: "98.76.54.32:6881", want: 0xec2d7224},
+		"same /24":           {a: "123.213.32.10:6881", b: "123.213.32.234:6881", want: 0x99568189},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, _ := net.ResolveTCPAddr("tcp", test.a)
+			b, _ := net.ResolveTCPAddr("tcp", test.b)
+
+			if got := gobt.CanonicalPriority(a, b); got != test.want {
+				t.Fatalf("want %#x, got %#x", test.want, got)
+			}
+
+			if got := gobt.CanonicalPriority(b, a); got != test.want {
+				t.Fatalf("want %#x for swapped peers, got %#x", test.want, got)
+			}
+		})
+	}
+}
+
+func TestConnManager(t *testing.T) {
+	t.Run("half open limit", func(t *testing.T) {
+		started := make(chan struct{}, 4)
+		release := make(chan struct{})
+		var mu sync.Mutex
+		dialing, most := 0, 0
+
+		dial := func(addr string) (net.Conn, error) {
+			mu.Lock()
+			dialing++
+			if dialing > most {
+				most = dialing
+			}
+			mu.Unlock()
+
+			started <- struct{}{}
+			<-release
+
+			mu.Lock()
+			dialing--
+			mu.Unlock()
+			return nil, errors.New("refused")
+		}
+
+		cm := gobt.NewConnManager(dial, func(peer *gobt.Peer) {})
+		cm.SetMaxHalfOpen(2)
+		cm.Add("10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1", "10.0.0.4:1")
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			cm.Run(stop)
+			close(done)
+		}()
+
+		<-started
+		<-started
+		if _, halfOpen := cm.Conns(); halfOpen != 2 {
+			t.Fatalf("want 2 half open, got %d", halfOpen)
+		}
+
+		close(release)
+		close(stop)
+		<-done
+
+		mu.Lock()
+		defer mu.Unlock()
+		if most > 2 {
+			t.Fatalf("want at most 2 dials at once, got %d", most)
+		}
+	})
+
+	t.Run("backoff", func(t *testing.T) {
+		dialed := make(chan string, 10)
+		var mu sync.Mutex
+		dials := map[string]int{}
+
+		dial := func(addr string) (net.Conn, error) {
+			mu.Lock()
+			dials[addr]++
+			mu.Unlock()
+
+			dialed <- addr
+			return nil, errors.New("refused")
+		}
+
+		cm := gobt.NewConnManager(dial, func(peer *gobt.Peer) {})
+		cm.Add("10.0.0.1:1")
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			cm.Run(stop)
+			close(done)
+		}()
+
+		// Manager dials again when candidate is added, failed candidate
+		// is still waiting for backoff
+		<-dialed
+		cm.Add("10.0.0.2:1")
+		for addr := range dialed {
+			if addr == "10.0.0.2:1" {
+				break
+			}
+		}
+
+		close(stop)
+		<-done
+
+		mu.Lock()
+		defer mu.Unlock()
+		if dials["10.0.0.1:1"] != 1 {
+			t.Fatalf("want 1 dial before backoff expires, got %d", dials["10.0.0.1:1"])
+		}
+	})
+
+	t.Run("max conns", func(t *testing.T) {
+		connected := make(chan struct{}, 2)
+		var mu sync.Mutex
+		handled := 0
+
+		dial := func(addr string) (net.Conn, error) {
+			conn, _ := net.Pipe()
+			return conn, nil
+		}
+
+		cm := gobt.NewConnManager(dial, func(peer *gobt.Peer) {
+			mu.Lock()
+			handled++
+			mu.Unlock()
+
+			connected <- struct{}{}
+			// Peer is closed once manager stops
+			peer.ReadMsg()
+		})
+		cm.SetMaxConns(1)
+		cm.Add("10.0.0.1:1", "10.0.0.2:1")
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			cm.Run(stop)
+			close(done)
+		}()
+
+		<-connected
+		if conns, halfOpen := cm.Conns(); conns != 1 || halfOpen != 0 {
+			t.Fatalf("want 1 connection, got %d and %d half open", conns, halfOpen)
+		}
+
+		close(stop)
+		<-done
+
+		mu.Lock()
+		defer mu.Unlock()
+		if handled != 1 {
+			t.Fatalf("want 1 handled peer, got %d", handled)
+		}
+	})
+
+	t.Run("dial after stop", func(t *testing.T) {
+		dialing := make(chan struct{})
+		release := make(chan struct{})
+		var late net.Conn
+
+		// First candidate connects at once, second finishes dial only
+		// after manager stopped
+		dial := func(addr string) (net.Conn, error) {
+			conn, remote := net.Pipe()
+			if addr == "10.0.0.2:1" {
+				late = remote
+				close(dialing)
+				<-release
+			}
+			return conn, nil
+		}
+
+		connected := make(chan struct{})
+		closed := make(chan struct{})
+		var mu sync.Mutex
+		handled := 0
+
+		cm := gobt.NewConnManager(dial, func(peer *gobt.Peer) {
+			mu.Lock()
+			handled++
+			mu.Unlock()
+
+			close(connected)
+			peer.ReadMsg()
+			close(closed)
+		})
+		cm.Add("10.0.0.1:1", "10.0.0.2:1")
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			cm.Run(stop)
+			close(done)
+		}()
+
+		<-connected
+		<-dialing
+		close(stop)
+		// Connected peer is closed once manager stopped
+		<-closed
+		close(release)
+		<-done
+
+		mu.Lock()
+		defer mu.Unlock()
+		if handled != 1 {
+			t.Fatalf("want 1 handled peer, got %d", handled)
+		}
+
+		if _, err := late.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("want closed connection, got nil")
+		}
+	})
+}
+
+func TestConnLimit(t *testing.T) {
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	defer close(release)
+
+	dial := func(addr string) (net.Conn, error) {
+		started <- struct{}{}
+		<-release
+		return nil, errors.New("refused")
+	}
+
+	// Two managers share limit of 3 dials
+	limit := gobt.NewConnLimit(0, 3)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for _, addrs := range [][]string{{"10.0.0.1:1", "10.0.0.2:1"}, {"10.0.1.1:1", "10.0.1.2:1"}} {
+		cm := gobt.NewConnManager(dial, func(peer *gobt.Peer) {})
+		cm.SetSharedLimit(limit)
+		cm.Add(addrs...)
+		go cm.Run(stop)
+	}
+
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	if _, halfOpen := limit.Conns(); halfOpen != 3 {
+		t.Fatalf("want 3 half open, got %d", halfOpen)
+	}
+}
@@ -0,0 +1,51 @@
+package gobt
+
+import "sync"
+
+const (
+	DefaultDiskWorkers = 4
+	// Disk jobs that can wait for worker before submit blocks
+	MaxDiskQueue = 64
+)
+
+// diskPool runs disk writes of all torrents of client on fixed number of
+// workers, so many torrents do not compete for disk at once.
+type diskPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+func newDiskPool(workers int) *diskPool {
+	p := &diskPool{jobs: make(chan func(), MaxDiskQueue)}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *diskPool) work() {
+	defer p.wg.Done()
+
+	for job := range p.jobs {
+		job()
+	}
+}
+
+// submit queues job, blocking while queue is full.
+func (p *diskPool) submit(job func()) {
+	p.jobs <- job
+}
+
+// queued returns number of jobs waiting for worker.
+func (p *diskPool) queued() int {
+	return len(p.jobs)
+}
+
+// close waits for queued jobs and stops workers.
+func (p *diskPool) close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
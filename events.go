@@ -0,0 +1,181 @@
+package gobt
+
+import (
+	"sync"
+	"time"
+)
+
+// Events that can wait in subscription before newer events are dropped
+const DefaultEventBuffer = 256
+
+type EventType int
+
+const (
+	EventPieceVerified EventType = iota
+	EventPieceFailed
+	EventPeerConnected
+	EventPeerDisconnected
+	EventPeerBanned
+	EventAnnounce
+	EventStateChanged
+	EventFileCompleted
+	EventStorageError
+)
+
+var eventNames = map[EventType]string{
+	EventPieceVerified:    "piece verified",
+	EventPieceFailed:      "piece failed",
+	EventPeerConnected:    "peer connected",
+	EventPeerDisconnected: "peer disconnected",
+	EventPeerBanned:       "peer banned",
+	EventAnnounce:         "announce",
+	EventStateChanged:     "state changed",
+	EventFileCompleted:    "file completed",
+	EventStorageError:     "storage error",
+}
+
+func (t EventType) String() string {
+	return eventNames[t]
+}
+
+type TorrentState int
+
+const (
+	StateStopped TorrentState = iota
+	StateDownloading
+	StateComplete
+	StateFailed
+)
+
+var stateNames = map[TorrentState]string{
+	StateStopped:     "stopped",
+	StateDownloading: "downloading",
+	StateComplete:    "complete",
+	StateFailed:      "failed",
+}
+
+func (s TorrentState) String() string {
+	return stateNames[s]
+}
+
+// Event is something that happened to torrent. Fields other than Type, Time
+// and Torrent are set only for types they relate to.
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Torrent [HashSize]byte
+
+	// Piece of piece and storage events
+	Piece int
+	// File index of file completed event
+	File int
+	// Peer address of peer and piece events
+	Peer string
+	// State of state changed event
+	State TorrentState
+	// Peers received in announce event
+	Peers int
+	// Err of failed announce, storage error, or why peer disconnected or
+	// was banned
+	Err error
+}
+
+// Subscription receives events until it is closed. Events are never waited
+// for: when buffer is full, new events are dropped and counted.
+type Subscription struct {
+	ch      chan Event
+	match   func(e Event) bool
+	dropped int
+	bus     *eventBus
+}
+
+// Events returns channel of events, closed when subscription is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns number of events dropped because buffer was full.
+func (s *Subscription) Dropped() int {
+	s.bus.Lock()
+	defer s.bus.Unlock()
+
+	return s.dropped
+}
+
+// Close stops delivery of events and closes events channel.
+func (s *Subscription) Close() {
+	s.bus.Lock()
+	defer s.bus.Unlock()
+
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.ch)
+	}
+}
+
+// eventBus delivers published events to every matching subscription.
+type eventBus struct {
+	subs map[*Subscription]struct{}
+
+	sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[*Subscription]struct{}{}}
+}
+
+func (b *eventBus) subscribe(buffer int, match func(e Event) bool) *Subscription {
+	b.Lock()
+	defer b.Unlock()
+
+	s := &Subscription{ch: make(chan Event, buffer), match: match, bus: b}
+	b.subs[s] = struct{}{}
+
+	return s
+}
+
+// onEvent calls fn with events of new subscription from its own goroutine,
+// so slow callback only drops its own events.
+func (b *eventBus) onEvent(fn func(e Event), match func(e Event) bool) *Subscription {
+	s := b.subscribe(DefaultEventBuffer, match)
+
+	go func() {
+		for e := range s.ch {
+			fn(e)
+		}
+	}()
+
+	return s
+}
+
+func (b *eventBus) publish(e Event) {
+	b.Lock()
+	defer b.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	for s := range b.subs {
+		if s.match != nil && !s.match(e) {
+			continue
+		}
+
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// close closes every subscription.
+func (b *eventBus) close() {
+	b.Lock()
+	defer b.Unlock()
+
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
@@ -0,0 +1,202 @@
+package gobt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage maps torrent content onto files on disk. Files are created
+// when data is first written to them, and writes to files that are not
+// wanted are discarded so skipped files are never allocated.
+type FileStorage struct {
+	dir     string
+	entries []FileEntry
+	files   []*os.File
+	wanted  []bool
+
+	sync.Mutex
+}
+
+func NewFileStorage(dir string, entries []FileEntry) *FileStorage {
+	wanted := make([]bool, len(entries))
+	for i := range wanted {
+		wanted[i] = true
+	}
+
+	return &FileStorage{dir: dir, entries: entries, files: make([]*os.File, len(entries)), wanted: wanted}
+}
+
+func (fs *FileStorage) Entries() []FileEntry {
+	return fs.entries
+}
+
+func (fs *FileStorage) SetWanted(fi int, wanted bool) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.wanted[fi] = wanted
+}
+
+// WriteAt writes content at offset to every wanted file it overlaps.
+func (fs *FileStorage) WriteAt(b []byte, off int64) (int, error) {
+	n, _, err := fs.writeAt(b, off)
+	return n, err
+}
+
+// writeAt is WriteAt that also returns files whose part of content was
+// discarded because they are not wanted.
+func (fs *FileStorage) writeAt(b []byte, off int64) (int, []int, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	dropped := []int{}
+	n, err := fs.rangeFiles(b, off, func(fi int, seg []byte, fileOff int64) (int, error) {
+		if !fs.wanted[fi] {
+			dropped = append(dropped, fi)
+			return len(seg), nil
+		}
+
+		f, err := fs.open(fi)
+		if err != nil {
+			return 0, err
+		}
+
+		return f.WriteAt(seg, fileOff)
+	})
+
+	return n, dropped, err
+}
+
+func (fs *FileStorage) ReadAt(b []byte, off int64) (int, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	n, err := fs.rangeFiles(b, off, func(fi int, seg []byte, fileOff int64) (int, error) {
+		if !fs.wanted[fi] {
+			for i := range seg {
+				seg[i] = 0
+			}
+			return len(seg), nil
+		}
+
+		f, err := fs.open(fi)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := f.ReadAt(seg, fileOff)
+		if err == io.EOF {
+			// File is not fully written yet
+			for i := n; i < len(seg); i++ {
+				seg[i] = 0
+			}
+			return len(seg), nil
+		}
+
+		return n, err
+	})
+	if err == nil && n < len(b) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// rangeFiles calls fn with parts of b that belong to each file.
+func (fs *FileStorage) rangeFiles(b []byte, off int64, fn func(fi int, seg []byte, fileOff int64) (int, error)) (int, error) {
+	done := 0
+
+	for fi, entry := range fs.entries {
+		start := entry.Offset
+		end := start + entry.Length
+		pos := off + int64(done)
+
+		if done == len(b) {
+			break
+		}
+		if pos >= end || entry.Length == 0 {
+			continue
+		}
+
+		length := int64(len(b) - done)
+		if pos+length > end {
+			length = end - pos
+		}
+
+		n, err := fn(fi, b[done:done+int(length)], pos-start)
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+
+	return done, nil
+}
+
+func (fs *FileStorage) open(fi int) (*os.File, error) {
+	if fs.files[fi] != nil {
+		return fs.files[fi], nil
+	}
+
+	path := fs.entries[fi].Path
+	if !filepath.IsLocal(path) {
+		return nil, fmt.Errorf("invalid file path: %s", path)
+	}
+
+	path = filepath.Join(fs.dir, path)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.files[fi] = f
+	return f, nil
+}
+
+func (fs *FileStorage) Close() error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	var err error
+	for i, f := range fs.files {
+		if f == nil {
+			continue
+		}
+
+		if cerr := f.Close(); cerr != nil {
+			err = cerr
+		}
+		fs.files[i] = nil
+	}
+
+	return err
+}
+
+// Remove closes and deletes all files that were created.
+func (fs *FileStorage) Remove() error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	var err error
+	for i, f := range fs.files {
+		if f == nil {
+			continue
+		}
+
+		f.Close()
+		if rerr := os.Remove(f.Name()); rerr != nil {
+			err = rerr
+		}
+		fs.files[i] = nil
+	}
+
+	return err
+}
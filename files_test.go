@@ -0,0 +1,46 @@
+package gobt_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/edwces/gobt"
+)
+
+func TestFileStorageWriteAt(t *testing.T) {
+	dir := t.TempDir()
+	entries := []gobt.FileEntry{
+		{Path: filepath.Join("t", "a"), Offset: 0, Length: 6},
+		{Path: filepath.Join("t", "b"), Offset: 6, Length: 4},
+		{Path: filepath.Join("t", "c"), Offset: 10, Length: 6},
+	}
+
+	fs := gobt.NewFileStorage(dir, entries)
+	defer fs.Close()
+	fs.SetWanted(1, false)
+
+	data := []byte("0123456789abcdef")
+	n, err := fs.WriteAt(data[4:12], 4)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+	if n != 8 {
+		t.Fatalf("want %d, got %d", 8, n)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "t", "b")); !os.IsNotExist(err) {
+		t.Fatalf("skipped file was created")
+	}
+
+	got, _ := os.ReadFile(filepath.Join(dir, "t", "c"))
+	if !bytes.Equal(got, []byte("ab")) {
+		t.Fatalf("want %q, got %q", "ab", got)
+	}
+
+	got, _ = os.ReadFile(filepath.Join(dir, "t", "a"))
+	if !bytes.Equal(got[4:], []byte("45")) {
+		t.Fatalf("want %q, got %q", "45", got[4:])
+	}
+}
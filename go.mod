@@ -1,6 +1,6 @@
 module github.com/edwces/gobt
 
-go 1.20
+go 1.21
 
 require (
 	github.com/jackpal/bencode-go v1.0.0
@@ -0,0 +1,75 @@
+package gobt
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Handler serves files of torrent content over HTTP while it is being
+// downloaded. Range requests are supported, and reads prioritise pieces
+// around the requested position so seeking moves the download ahead.
+type Handler struct {
+	entries []FileEntry
+	data    io.ReaderAt
+	picker  *Picker
+	layout  Layout
+	modtime time.Time
+}
+
+func NewHandler(entries []FileEntry, data io.ReaderAt, picker *Picker, layout Layout) *Handler {
+	return &Handler{entries: entries, data: data, picker: picker, layout: layout, modtime: time.Now()}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	if path == "" {
+		h.serveIndex(w)
+		return
+	}
+
+	for fi, entry := range h.entries {
+		if filepath.ToSlash(entry.Path) != path || h.picker.FilePriority(fi) == PrioritySkip {
+			continue
+		}
+
+		reader := NewReader(h.data, h.picker, h.layout)
+		defer reader.Close()
+		reader.SetContext(r.Context())
+
+		file := io.NewSectionReader(reader, entry.Offset, entry.Length)
+		http.ServeContent(w, r, filepath.Base(entry.Path), h.modtime, file)
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+func (h *Handler) serveIndex(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	for fi, entry := range h.entries {
+		if h.picker.FilePriority(fi) == PrioritySkip {
+			continue
+		}
+
+		path := filepath.ToSlash(entry.Path)
+		fmt.Fprintf(w, "<a href=\"/%s\">%s</a><br>\n", html.EscapeString(escapePath(path)), html.EscapeString(path))
+	}
+}
+
+// escapePath escapes each segment of slash separated path for use in URL.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
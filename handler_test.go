@@ -0,0 +1,89 @@
+package gobt_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/edwces/gobt"
+)
+
+func TestHandlerRange(t *testing.T) {
+	data := make([]byte, TestTorrentLength)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	p := gobt.NewPicker(TestTorrentLayout)
+	for i := 0; i < TestTorrentTotalPieces; i++ {
+		p.MarkPieceVerified(i)
+	}
+
+	entries := []gobt.FileEntry{
+		{Path: "dir/a.bin", Offset: 0, Length: 50000},
+		{Path: "dir/b.bin", Offset: 50000, Length: TestTorrentLength - 50000},
+	}
+	h := gobt.NewHandler(entries, bytes.NewReader(data), p, TestTorrentLayout)
+
+	req := httptest.NewRequest(http.MethodGet, "/dir/b.bin", nil)
+	req.Header.Set("Range", "bytes=100000-100099")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	res := rec.Result()
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("want %d, got %d", http.StatusPartialContent, res.StatusCode)
+	}
+
+	got, _ := io.ReadAll(res.Body)
+	if !bytes.Equal(got, data[150000:150100]) {
+		t.Fatalf("range data does not match")
+	}
+}
+
+func TestHandlerIndex(t *testing.T) {
+	data := make([]byte, TestTorrentLength)
+
+	p := gobt.NewPicker(TestTorrentLayout)
+	for i := 0; i < TestTorrentTotalPieces; i++ {
+		p.MarkPieceVerified(i)
+	}
+
+	tests := map[string]struct {
+		path string
+		href string
+	}{
+		"fragment": {path: "dir/a#1.bin", href: "/dir/a%231.bin"},
+		"query":    {path: "dir/b?.bin", href: "/dir/b%3F.bin"},
+		"percent":  {path: "c%20.bin", href: "/c%2520.bin"},
+	}
+
+	entries := []gobt.FileEntry{}
+	for _, test := range tests {
+		entries = append(entries, gobt.FileEntry{Path: test.path, Offset: 0, Length: 100})
+	}
+	h := gobt.NewHandler(entries, bytes.NewReader(data), p, TestTorrentLayout)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	index := rec.Body.String()
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if !strings.Contains(index, `href="`+test.href+`"`) {
+				t.Fatalf("want link to %s, got %s", test.href, index)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.href, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want %d, got %d", http.StatusOK, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package gobt
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// MaxBlockLength is length of requested blocks. Most clients reject
+	// requests for more than 16 KiB.
+	MaxBlockLength = 16 * 1024
+
+	// Pieces are buffered whole, so piece length must fit in int even on
+	// 32-bit platforms
+	MaxPieceLength = math.MaxInt32
+	// Piece index is sent as uint32 and used as int
+	MaxPieceCount = math.MaxInt32
+)
+
+// Layout describes how torrent content is split into pieces and pieces into
+// blocks. Every piece except the last is PieceLength long, and every block
+// except the last block of a piece is BlockLength long.
+type Layout struct {
+	Length      int64
+	PieceLength int64
+	BlockLength int
+}
+
+// NewLayout creates layout of content with given length and piece length
+// with blocks of MaxBlockLength.
+func NewLayout(length, pieceLength int64) Layout {
+	return Layout{Length: length, PieceLength: pieceLength, BlockLength: MaxBlockLength}
+}
+
+// Validate checks that content can be split into pieces addressable by
+// peer protocol and buffered in memory.
+func (l Layout) Validate() error {
+	if l.Length < 0 {
+		return fmt.Errorf("invalid length: %d", l.Length)
+	}
+	if l.PieceLength <= 0 || l.PieceLength > MaxPieceLength {
+		return fmt.Errorf("invalid piece length: %d", l.PieceLength)
+	}
+	if l.BlockLength <= 0 || l.BlockLength > MaxBlockLength {
+		return fmt.Errorf("invalid block length: %d", l.BlockLength)
+	}
+	if count := ceilDiv(l.Length, l.PieceLength); count > MaxPieceCount {
+		return fmt.Errorf("too many pieces: %d", count)
+	}
+
+	return nil
+}
+
+// PieceCount returns number of pieces in content.
+func (l Layout) PieceCount() int {
+	return int(ceilDiv(l.Length, l.PieceLength))
+}
+
+// PieceOffset returns offset of piece in content.
+func (l Layout) PieceOffset(pi int) int64 {
+	return int64(pi) * l.PieceLength
+}
+
+// PieceSize returns length of piece, which is shorter for the last piece.
+func (l Layout) PieceSize(pi int) int {
+	offset := l.PieceOffset(pi)
+	if offset+l.PieceLength > l.Length {
+		return int(l.Length - offset)
+	}
+
+	return int(l.PieceLength)
+}
+
+// PieceAt returns index of piece holding content offset.
+func (l Layout) PieceAt(offset int64) int {
+	return int(offset / l.PieceLength)
+}
+
+// BlockCount returns number of blocks in piece.
+func (l Layout) BlockCount(pi int) int {
+	return int(ceilDiv(int64(l.PieceSize(pi)), int64(l.BlockLength)))
+}
+
+// BlockOffset returns offset of block in piece.
+func (l Layout) BlockOffset(bi int) int {
+	return bi * l.BlockLength
+}
+
+// BlockSize returns length of block, which is shorter for the last block of
+// the last piece.
+func (l Layout) BlockSize(pi, bi int) int {
+	rest := l.PieceSize(pi) - l.BlockOffset(bi)
+	if rest < l.BlockLength {
+		return rest
+	}
+
+	return l.BlockLength
+}
+
+// BlockAt returns index of block holding piece offset.
+func (l Layout) BlockAt(offset int) int {
+	return offset / l.BlockLength
+}
+
+// Request returns request for block of piece.
+func (l Layout) Request(pi, bi int) BlockRequest {
+	return BlockRequest{Index: pi, Offset: l.BlockOffset(bi), Length: l.BlockSize(pi, bi)}
+}
+
+func ceilDiv(a, b int64) int64 {
+	if a%b == 0 {
+		return a / b
+	}
+
+	return a/b + 1
+}
@@ -0,0 +1,104 @@
+package gobt_test
+
+import (
+	"testing"
+
+	"github.com/edwces/gobt"
+)
+
+func TestLayout(t *testing.T) {
+	// Two full pieces of 3 blocks and last piece of one and a half block
+	pieceLength := int64(3 * gobt.MaxBlockLength)
+	layout := gobt.NewLayout(2*pieceLength+gobt.MaxBlockLength+gobt.MaxBlockLength/2, pieceLength)
+
+	if count := layout.PieceCount(); count != 3 {
+		t.Fatalf("want 3 pieces, got %d", count)
+	}
+
+	tests := map[string]struct {
+		pi, bi     int
+		pieceSize  int
+		blockCount int
+		want       gobt.BlockRequest
+	}{
+		"first block":  {pi: 0, bi: 0, pieceSize: 3 * gobt.MaxBlockLength, blockCount: 3, want: gobt.BlockRequest{Index: 0, Offset: 0, Length: gobt.MaxBlockLength}},
+		"middle piece": {pi: 1, bi: 2, pieceSize: 3 * gobt.MaxBlockLength, blockCount: 3, want: gobt.BlockRequest{Index: 1, Offset: 2 * gobt.MaxBlockLength, Length: gobt.MaxBlockLength}},
+		"last block":   {pi: 2, bi: 1, pieceSize: gobt.MaxBlockLength + gobt.MaxBlockLength/2, blockCount: 2, want: gobt.BlockRequest{Index: 2, Offset: gobt.MaxBlockLength, Length: gobt.MaxBlockLength / 2}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if size := layout.PieceSize(test.pi); size != test.pieceSize {
+				t.Fatalf("want piece size %d, got %d", test.pieceSize, size)
+			}
+
+			if count := layout.BlockCount(test.pi); count != test.blockCount {
+				t.Fatalf("want %d blocks, got %d", test.blockCount, count)
+			}
+
+			if req := layout.Request(test.pi, test.bi); req != test.want {
+				t.Fatalf("want %v, got %v", test.want, req)
+			}
+
+			if bi := layout.BlockAt(test.want.Offset); bi != test.bi {
+				t.Fatalf("want block %d, got %d", test.bi, bi)
+			}
+		})
+	}
+}
+
+func TestLayoutLarge(t *testing.T) {
+	tests := map[string]struct {
+		length      int64
+		pieceLength int64
+		count       int
+		lastOffset  int64
+		lastSize    int
+	}{
+		"over 4 GiB":      {length: 5<<30 + 1, pieceLength: 1 << 20, count: 5<<10 + 1, lastOffset: 5 << 30, lastSize: 1},
+		"over 2^53 bytes": {length: 1<<53 + 1, pieceLength: 1 << 30, count: 1<<23 + 1, lastOffset: 1 << 53, lastSize: 1},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			layout := gobt.NewLayout(test.length, test.pieceLength)
+
+			if err := layout.Validate(); err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			if count := layout.PieceCount(); count != test.count {
+				t.Fatalf("want %d pieces, got %d", test.count, count)
+			}
+
+			last := test.count - 1
+			if offset := layout.PieceOffset(last); offset != test.lastOffset {
+				t.Fatalf("want offset %d, got %d", test.lastOffset, offset)
+			}
+
+			if size := layout.PieceSize(last); size != test.lastSize {
+				t.Fatalf("want size %d, got %d", test.lastSize, size)
+			}
+
+			if pi := layout.PieceAt(test.length - 1); pi != last {
+				t.Fatalf("want piece %d, got %d", last, pi)
+			}
+		})
+	}
+}
+
+func TestLayoutValidate(t *testing.T) {
+	tests := map[string]gobt.Layout{
+		"zero piece length":       gobt.NewLayout(1<<20, 0),
+		"piece length over int32": gobt.NewLayout(1<<40, 1<<32),
+		"too many pieces":         gobt.NewLayout(1<<62, gobt.MaxBlockLength),
+	}
+
+	for name, layout := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := layout.Validate(); err == nil {
+				t.Fatalf("want err, got nil")
+			}
+		})
+	}
+}
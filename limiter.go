@@ -0,0 +1,171 @@
+package gobt
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// LimiterBurst is the most bytes limiter lets through at once. Larger
+// transfers wait in chunks, so peers sharing a limiter take turns.
+const LimiterBurst = 4 * MaxBlockLength
+
+// Limiter is token bucket limiting transfer to a rate in bytes per second.
+// Waiting callers are served in order of arrival. Nil or zero rate limiter
+// does not limit.
+type Limiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	sync.Mutex
+}
+
+func NewLimiter(rate int) *Limiter {
+	return &Limiter{rate: float64(rate), tokens: LimiterBurst, last: time.Now()}
+}
+
+// SetLimit changes rate in bytes per second, 0 removes the limit. Callers
+// that are already waiting keep their delay.
+func (l *Limiter) SetLimit(rate int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.refill(time.Now())
+	l.rate = float64(rate)
+}
+
+func (l *Limiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	return int(l.rate)
+}
+
+// WaitN blocks until n bytes can be transferred.
+func (l *Limiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+
+	for n > 0 {
+		chunk := n
+		if chunk > LimiterBurst {
+			chunk = LimiterBurst
+		}
+
+		time.Sleep(l.reserve(chunk))
+		n -= chunk
+	}
+}
+
+// reserve takes n tokens, going into debt if there are not enough, and
+// returns how long caller has to wait until the debt is paid.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.refill(now)
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate <= 0 {
+		l.tokens = LimiterBurst
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > LimiterBurst {
+			l.tokens = LimiterBurst
+		}
+	}
+
+	l.last = now
+}
+
+// BandwidthLimit limits download and upload of one level, such as whole
+// client, torrent or peer.
+type BandwidthLimit struct {
+	Download *Limiter
+	Upload   *Limiter
+}
+
+// NewBandwidthLimit creates limit with rates in bytes per second, 0 for
+// unlimited.
+func NewBandwidthLimit(download, upload int) *BandwidthLimit {
+	return &BandwidthLimit{Download: NewLimiter(download), Upload: NewLimiter(upload)}
+}
+
+// SetLimit changes download and upload rates at runtime.
+func (bl *BandwidthLimit) SetLimit(download, upload int) {
+	bl.Download.SetLimit(download)
+	bl.Upload.SetLimit(upload)
+}
+
+func waitDownload(limits []*BandwidthLimit, n int) {
+	for _, limit := range limits {
+		if limit != nil {
+			limit.Download.WaitN(n)
+		}
+	}
+}
+
+func waitUpload(limits []*BandwidthLimit, n int) {
+	for _, limit := range limits {
+		if limit != nil {
+			limit.Upload.WaitN(n)
+		}
+	}
+}
+
+// limitedReader waits for download limits after each read.
+type limitedReader struct {
+	r    io.Reader
+	peer *Peer
+}
+
+func (lr limitedReader) Read(b []byte) (int, error) {
+	if len(b) > LimiterBurst {
+		b = b[:LimiterBurst]
+	}
+
+	n, err := lr.r.Read(b)
+	waitDownload(lr.peer.bandwidthLimits(), n)
+
+	return n, err
+}
+
+// isLocalAddr reports whether address is on loopback or local network.
+func isLocalAddr(addr net.Addr) bool {
+	var ip net.IP
+
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
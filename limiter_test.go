@@ -0,0 +1,47 @@
+package gobt_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edwces/gobt"
+)
+
+func TestLimiter(t *testing.T) {
+	tests := map[string]struct {
+		rate    int
+		n       int
+		atLeast time.Duration
+		atMost  time.Duration
+	}{
+		"unlimited": {rate: 0, n: 1 << 20, atLeast: 0, atMost: 50 * time.Millisecond},
+		"burst":     {rate: 1 << 20, n: gobt.LimiterBurst, atLeast: 0, atMost: 50 * time.Millisecond},
+		"limited":   {rate: 1 << 20, n: gobt.LimiterBurst + 1<<18, atLeast: 200 * time.Millisecond, atMost: time.Second},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			l := gobt.NewLimiter(test.rate)
+
+			start := time.Now()
+			l.WaitN(test.n)
+			elapsed := time.Since(start)
+
+			if elapsed < test.atLeast || elapsed > test.atMost {
+				t.Fatalf("want between %v and %v, got %v", test.atLeast, test.atMost, elapsed)
+			}
+		})
+	}
+
+	t.Run("set limit", func(t *testing.T) {
+		l := gobt.NewLimiter(1)
+		l.SetLimit(0)
+
+		start := time.Now()
+		l.WaitN(1 << 20)
+
+		if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+			t.Fatalf("want no wait after removing limit, got %v", elapsed)
+		}
+	})
+}
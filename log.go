@@ -0,0 +1,53 @@
+package gobt
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Subsystems that have their own log level
+const (
+	LogTracker = "tracker"
+	LogWire    = "wire"
+	LogPicker  = "picker"
+	LogStorage = "storage"
+)
+
+// LevelTrace is level of every message sent and received by peers, logged
+// only when level of wire subsystem is set to it.
+const LevelTrace = slog.LevelDebug - 4
+
+var logSubsystems = []string{LogTracker, LogWire, LogPicker, LogStorage}
+
+// levelHandler drops records below level before passing them to handler,
+// so each subsystem can have its own level over one shared handler.
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
+
+// discardHandler drops every record, used until logger is set.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
@@ -5,6 +5,7 @@ import (
 	"crypto/sha1"
 	"errors"
 	"io"
+	"path/filepath"
 
 	bencode "github.com/jackpal/bencode-go"
 )
@@ -14,13 +15,27 @@ const HashSize = sha1.Size
 type Metainfo struct {
 	Announce string `bencode:"announce"`
 	Info     struct {
+		Files       []File `bencode:"files,omitempty"`
 		Name        string `bencode:"name"`
-		Length      int    `bencode:"length"`
-		PieceLength int    `bencode:"piece length"`
+		Length      int64  `bencode:"length,omitempty"`
+		PieceLength int64  `bencode:"piece length"`
 		Pieces      string `bencode:"pieces"`
 	} `bencode:"info"`
 }
 
+// File is an entry of multi-file torrent.
+type File struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// FileEntry is a file placed in contiguous torrent content.
+type FileEntry struct {
+	Path   string
+	Offset int64
+	Length int64
+}
+
 func UnmarshalMetainfo(r io.Reader) (*Metainfo, error) {
 	mi := &Metainfo{}
 	err := bencode.Unmarshal(r, mi)
@@ -60,3 +75,41 @@ func (m Metainfo) PieceHashes() ([][HashSize]byte, error) {
 
 	return hashes, nil
 }
+
+// TotalLength returns length of whole torrent content.
+func (m Metainfo) TotalLength() int64 {
+	if len(m.Info.Files) == 0 {
+		return m.Info.Length
+	}
+
+	total := int64(0)
+	for _, f := range m.Info.Files {
+		total += f.Length
+	}
+
+	return total
+}
+
+// Layout returns piece and block layout of torrent content.
+func (m Metainfo) Layout() Layout {
+	return NewLayout(m.TotalLength(), m.Info.PieceLength)
+}
+
+// FileEntries returns files in content order. Files of multi-file torrent
+// are placed in directory named after the torrent.
+func (m Metainfo) FileEntries() []FileEntry {
+	if len(m.Info.Files) == 0 {
+		return []FileEntry{{Path: m.Info.Name, Offset: 0, Length: m.Info.Length}}
+	}
+
+	entries := make([]FileEntry, len(m.Info.Files))
+	offset := int64(0)
+
+	for i, f := range m.Info.Files {
+		path := filepath.Join(append([]string{m.Info.Name}, f.Path...)...)
+		entries[i] = FileEntry{Path: path, Offset: offset, Length: f.Length}
+		offset += f.Length
+	}
+
+	return entries
+}
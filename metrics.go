@@ -0,0 +1,147 @@
+package gobt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MetricsHandler serves metrics of client and its torrents in Prometheus
+// text format. Metrics are collected on every request.
+type MetricsHandler struct {
+	client *Client
+}
+
+func NewMetricsHandler(c *Client) *MetricsHandler {
+	return &MetricsHandler{client: c}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	for _, family := range h.client.collect() {
+		family.write(bw)
+	}
+	bw.Flush()
+}
+
+type metricType string
+
+const (
+	metricCounter metricType = "counter"
+	metricGauge   metricType = "gauge"
+)
+
+// metricFamily is metric with samples of every label set, written together
+// as Prometheus expects.
+type metricFamily struct {
+	name    string
+	help    string
+	typ     metricType
+	samples []metricSample
+}
+
+type metricSample struct {
+	// labels are pairs of name and value
+	labels []string
+	value  float64
+}
+
+func (f *metricFamily) add(value float64, labels ...string) {
+	f.samples = append(f.samples, metricSample{labels: labels, value: value})
+}
+
+func (f *metricFamily) write(w *bufio.Writer) {
+	w.WriteString("# HELP " + f.name + " " + f.help + "\n")
+	w.WriteString("# TYPE " + f.name + " " + string(f.typ) + "\n")
+
+	for _, sample := range f.samples {
+		w.WriteString(f.name)
+
+		for i := 0; i+1 < len(sample.labels); i += 2 {
+			if i == 0 {
+				w.WriteByte('{')
+			} else {
+				w.WriteByte(',')
+			}
+			w.WriteString(sample.labels[i] + `="` + labelEscaper.Replace(sample.labels[i+1]) + `"`)
+		}
+		if len(sample.labels) > 0 {
+			w.WriteByte('}')
+		}
+
+		w.WriteString(" " + strconv.FormatFloat(sample.value, 'g', -1, 64) + "\n")
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// collect returns metrics of client and every torrent.
+func (c *Client) collect() []*metricFamily {
+	downloaded := &metricFamily{name: "gobt_downloaded_bytes_total", help: "Piece data downloaded from peers.", typ: metricCounter}
+	uploaded := &metricFamily{name: "gobt_uploaded_bytes_total", help: "Piece data uploaded to peers.", typ: metricCounter}
+	verified := &metricFamily{name: "gobt_pieces_verified_total", help: "Pieces that passed hash check and were written.", typ: metricCounter}
+	failed := &metricFamily{name: "gobt_pieces_failed_total", help: "Pieces that failed hash check.", typ: metricCounter}
+	peers := &metricFamily{name: "gobt_peers", help: "Connected peers by choke and interest state; a peer can be in several states.", typ: metricGauge}
+	requests := &metricFamily{name: "gobt_outstanding_requests", help: "Block requests sent to peers and not received yet.", typ: metricGauge}
+	mode := &metricFamily{name: "gobt_picker_mode", help: "Pick mode of torrent, 1 for current mode.", typ: metricGauge}
+	trackerErrors := &metricFamily{name: "gobt_tracker_errors_total", help: "Failed announces to tracker.", typ: metricCounter}
+	disk := &metricFamily{name: "gobt_disk_queue_depth", help: "Verified pieces waiting to be written to disk.", typ: metricGauge}
+	memoryUsed := &metricFamily{name: "gobt_memory_used_bytes", help: "Memory reserved for unverified piece data.", typ: metricGauge}
+	memoryLimit := &metricFamily{name: "gobt_memory_limit_bytes", help: "Limit of memory for unverified piece data, 0 for unlimited.", typ: metricGauge}
+
+	for _, t := range c.Torrents() {
+		labels := []string{"torrent", hex.EncodeToString(t.hash[:]), "name", t.Name()}
+		stats := t.Stats()
+
+		downloaded.add(float64(stats.Downloaded), labels...)
+		uploaded.add(float64(stats.Uploaded), labels...)
+		verified.add(float64(t.counts.verified.Load()), labels...)
+		failed.add(float64(t.counts.failed.Load()), labels...)
+		trackerErrors.add(float64(t.counts.trackerErrors.Load()), labels...)
+
+		states := map[string]int{}
+		outstanding := 0
+		for _, ps := range t.PeerStats() {
+			outstanding += ps.Requests
+			states["connected"]++
+
+			for state, in := range map[string]bool{
+				"am_choking":      ps.AmChoking,
+				"am_interested":   ps.AmInterested,
+				"peer_choking":    ps.PeerChoking,
+				"peer_interested": ps.PeerInterested,
+				"snubbed":         ps.Snubbed,
+			} {
+				if in {
+					states[state]++
+				}
+			}
+		}
+
+		for _, state := range []string{"connected", "am_choking", "am_interested", "peer_choking", "peer_interested", "snubbed"} {
+			peers.add(float64(states[state]), append(labels, "state", state)...)
+		}
+		requests.add(float64(outstanding), labels...)
+
+		current := t.picker.Mode()
+		for m := PickRandom; m <= PickCustom; m++ {
+			value := 0.0
+			if m == current {
+				value = 1
+			}
+			mode.add(value, append(labels, "mode", m.String())...)
+		}
+	}
+
+	disk.add(float64(c.disk.queued()))
+
+	used, limit := c.MemoryUsage()
+	memoryUsed.add(float64(used))
+	memoryLimit.add(float64(limit))
+
+	return []*metricFamily{downloaded, uploaded, verified, failed, peers, requests, mode, trackerErrors, disk, memoryUsed, memoryLimit}
+}
@@ -0,0 +1,216 @@
+package gobt
+
+import (
+	"math/rand"
+
+	"golang.org/x/exp/slices"
+)
+
+type location int
+
+const (
+	locNone location = iota
+	locQueued
+	locProgress
+)
+
+// RandomPieceSamples is number of random picks tried before queued pieces
+// are scanned from random position.
+const RandomPieceSamples = 8
+
+// priorityBuckets holds queued pieces of one priority. Pieces are grouped
+// into buckets by availability, and also kept in a flat list for random
+// choice.
+type priorityBuckets struct {
+	buckets [][]int
+	all     []int
+}
+
+// pieceOrder tracks piece availability and keeps pieces that can be picked
+// ordered by priority and availability. Queued pieces live in availability
+// buckets so every update is O(1), in progress pieces are few and kept in a
+// sorted slice.
+type pieceOrder struct {
+	avail     []int
+	loc       []location
+	prio      []Priority
+	bucketPos []int
+	allPos    []int
+
+	queued      [PriorityHigh + 1]priorityBuckets
+	queuedCount int
+	progress    []int
+}
+
+// newPieceOrder creates order with every piece queued with normal priority.
+func newPieceOrder(count int) *pieceOrder {
+	o := &pieceOrder{
+		avail:     make([]int, count),
+		loc:       make([]location, count),
+		prio:      make([]Priority, count),
+		bucketPos: make([]int, count),
+		allPos:    make([]int, count),
+	}
+
+	all := make([]int, count)
+	bucket := make([]int, count)
+	for pi := 0; pi < count; pi++ {
+		all[pi] = pi
+		bucket[pi] = pi
+		o.loc[pi] = locQueued
+		o.prio[pi] = PriorityNormal
+		o.bucketPos[pi] = pi
+		o.allPos[pi] = pi
+	}
+
+	o.queued[PriorityNormal] = priorityBuckets{buckets: [][]int{bucket}, all: all}
+	o.queuedCount = count
+
+	return o
+}
+
+// set moves piece to location with given priority.
+func (o *pieceOrder) set(pi int, loc location, prio Priority) {
+	if o.loc[pi] == loc && o.prio[pi] == prio {
+		return
+	}
+
+	o.detach(pi)
+	o.loc[pi] = loc
+	o.prio[pi] = prio
+
+	switch loc {
+	case locQueued:
+		o.pushQueued(pi)
+	case locProgress:
+		o.progress = append(o.progress, pi)
+		o.sortProgress()
+	}
+}
+
+func (o *pieceOrder) increment(pi int) {
+	o.changeAvailability(pi, 1)
+}
+
+func (o *pieceOrder) decrement(pi int) {
+	if o.avail[pi] > 0 {
+		o.changeAvailability(pi, -1)
+	}
+}
+
+func (o *pieceOrder) changeAvailability(pi int, delta int) {
+	switch o.loc[pi] {
+	case locQueued:
+		o.removeQueued(pi)
+		o.avail[pi] += delta
+		o.pushQueued(pi)
+	case locProgress:
+		o.avail[pi] += delta
+		o.sortProgress()
+	default:
+		o.avail[pi] += delta
+	}
+}
+
+// remaining returns number of pieces that are queued or in progress.
+func (o *pieceOrder) remaining() int {
+	return o.queuedCount + len(o.progress)
+}
+
+// rangeQueued calls fn for queued pieces by priority, then rarest first.
+func (o *pieceOrder) rangeQueued(fn func(pi int) bool) {
+	for prio := PriorityHigh; prio > PrioritySkip; prio-- {
+		for _, bucket := range o.queued[prio].buckets {
+			for _, pi := range bucket {
+				if !fn(pi) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// rangeRandom calls fn for queued pieces by priority, in random order
+// within the same priority. A few random samples are tried first, then
+// pieces are visited from random position, so fn may see a piece twice.
+func (o *pieceOrder) rangeRandom(r *rand.Rand, fn func(pi int) bool) {
+	for prio := PriorityHigh; prio > PrioritySkip; prio-- {
+		all := o.queued[prio].all
+		if len(all) == 0 {
+			continue
+		}
+
+		for i := 0; i < RandomPieceSamples && i < len(all); i++ {
+			if !fn(all[r.Intn(len(all))]) {
+				return
+			}
+		}
+
+		start := r.Intn(len(all))
+		for i := 0; i < len(all); i++ {
+			if !fn(all[(start+i)%len(all)]) {
+				return
+			}
+		}
+	}
+}
+
+func (o *pieceOrder) detach(pi int) {
+	switch o.loc[pi] {
+	case locQueued:
+		o.removeQueued(pi)
+	case locProgress:
+		o.progress = slices.DeleteFunc(o.progress, func(e int) bool { return e == pi })
+	}
+
+	o.loc[pi] = locNone
+}
+
+func (o *pieceOrder) pushQueued(pi int) {
+	pb := &o.queued[o.prio[pi]]
+	avail := o.avail[pi]
+
+	for len(pb.buckets) <= avail {
+		pb.buckets = append(pb.buckets, nil)
+	}
+
+	o.bucketPos[pi] = len(pb.buckets[avail])
+	pb.buckets[avail] = append(pb.buckets[avail], pi)
+	o.allPos[pi] = len(pb.all)
+	pb.all = append(pb.all, pi)
+	o.queuedCount++
+}
+
+func (o *pieceOrder) removeQueued(pi int) {
+	pb := &o.queued[o.prio[pi]]
+	avail := o.avail[pi]
+
+	pb.buckets[avail] = swapRemove(pb.buckets[avail], o.bucketPos[pi], o.bucketPos)
+	if len(pb.buckets[avail]) == 0 {
+		// Release empty bucket, otherwise buckets left behind by rising
+		// availability keep their memory
+		pb.buckets[avail] = nil
+	}
+	pb.all = swapRemove(pb.all, o.allPos[pi], o.allPos)
+	o.queuedCount--
+}
+
+// swapRemove removes element at i by moving the last element in its place
+// and updating its position.
+func swapRemove(list []int, i int, pos []int) []int {
+	last := list[len(list)-1]
+	list[i] = last
+	pos[last] = i
+
+	return list[:len(list)-1]
+}
+
+func (o *pieceOrder) sortProgress() {
+	slices.SortFunc(o.progress, func(a, b int) int {
+		if o.prio[a] != o.prio[b] {
+			return int(o.prio[b]) - int(o.prio[a])
+		}
+
+		return o.avail[a] - o.avail[b]
+	})
+}
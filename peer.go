@@ -1,121 +1,417 @@
 package gobt
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/edwces/gobt/bitfield"
 	"github.com/edwces/gobt/protocol"
+	"golang.org/x/exp/slices"
 )
 
 const (
-	MaxRequestCountPerPeer = 5
-	MaxHashFails           = 15
+	MaxHashFails = 15
+
+	// Queue depth of peer that timed out on a request
+	SnubbedRequestCount = 1
+
+	MinRequestTimeout = 10 * time.Second
+	MaxRequestTimeout = 60 * time.Second
+	// Multiple of expected block time after which request times out
+	RequestTimeoutFactor = 4
+)
+
+var (
+	// ErrCancelledBlock is returned by RecvRequest for block that was
+	// cancelled but still sent by peer.
+	ErrCancelledBlock = errors.New("cancelled block")
+	// ErrUnrequestedBlock is returned by RecvRequest for block that was
+	// never requested from peer.
+	ErrUnrequestedBlock = errors.New("unrequested block")
 )
 
+// BlockRequest identifies requested block by piece index, offset and length.
+type BlockRequest struct {
+	Index  int
+	Offset int
+	Length int
+}
+
+// PeerState is choke and interest state of connection in both directions.
+// Connection starts with both sides choking and not interested.
+type PeerState struct {
+	// We do not serve requests of peer
+	AmChoking bool
+	// Peer has pieces we want
+	AmInterested bool
+	// Peer does not serve our requests
+	PeerChoking bool
+	// Peer wants pieces we have
+	PeerInterested bool
+}
+
 type Peer struct {
 	conn net.Conn
+	// id is peer ID sent in handshake
+	id [20]byte
+	// extensions is set when peer supports extension protocol
+	extensions bool
+	logger     atomic.Pointer[slog.Logger]
 
-	IsInteresting bool
-	IsChoking     bool
-
-	Requests  [][]int
-	Cancelled [][]int
 	HashFails int
-
-	keepAlivePeriod time.Duration
-	keepAliveTicker *time.Ticker
+	// Wasted is number of bytes received in blocks that were not requested
+	// or were cancelled.
+	Wasted int
+	// Limit is bandwidth limit of this peer only.
+	Limit *BandwidthLimit
+
+	state  PeerState
+	pieces bitfield.Bitfield
+	// wanted are pieces of peer that we want, counted in wantedCount so
+	// interest does not need to scan every piece
+	wanted      bitfield.Bitfield
+	wantedCount int
+	want        func(pi int) bool
+	onState     func(peer *Peer, old PeerState)
+
+	requests  map[BlockRequest]time.Time
+	cancelled map[BlockRequest]struct{}
+	snubbed   bool
+	pipeline  pipeline
+	counters  transferCounters
+	shared    []*BandwidthLimit
+	mu        sync.Mutex
+
+	writer    *peerWriter
+	closeOnce sync.Once
 }
 
+// NewPeer creates peer on connection and starts goroutine writing its
+// outbound messages.
 func NewPeer(conn net.Conn) *Peer {
-	return &Peer{conn: conn, IsInteresting: false, IsChoking: true, Requests: [][]int{}, Cancelled: [][]int{}, HashFails: 0}
+	p := &Peer{conn: conn, state: PeerState{AmChoking: true, PeerChoking: true}, requests: map[BlockRequest]time.Time{}, cancelled: map[BlockRequest]struct{}{}, pipeline: newPipeline(), Limit: NewBandwidthLimit(0, 0), HashFails: 0}
+	p.logger.Store(discardLogger)
+	p.writer = newPeerWriter(conn, p)
+	go p.writer.run()
+
+	return p
 }
 
 func (p *Peer) Handshake(hash, clientID [20]byte) error {
 	hs := protocol.NewHandshake(hash, clientID)
-	p.conn.Write(hs.Marshal())
+	hs.SetExtensions()
+	out := hs.Marshal()
+	p.conn.Write(out)
+	p.counters.sent(0, len(out), time.Now())
 
 	hs, err := protocol.UnmarshalHandshake(p.conn)
 	if err != nil {
 		return err
 	}
+	p.counters.recv(0, len(hs.Marshal()), time.Now())
 
 	if hs.InfoHash != hash {
 		return fmt.Errorf("InfoHash unexpected value: %s", hs.InfoHash)
 	}
+	p.setRemote(hs)
 
 	return nil
 }
 
+// AcceptHandshake answers handshake of incoming connection if known reports
+// info hash peer asked for. It returns the info hash.
+func (p *Peer) AcceptHandshake(clientID [20]byte, known func(hash [20]byte) bool) ([20]byte, error) {
+	hs, err := protocol.UnmarshalHandshake(p.conn)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	p.counters.recv(0, len(hs.Marshal()), time.Now())
+
+	if !known(hs.InfoHash) {
+		return hs.InfoHash, fmt.Errorf("InfoHash unknown: %x", hs.InfoHash)
+	}
+	p.setRemote(hs)
+
+	answer := protocol.NewHandshake(hs.InfoHash, clientID)
+	answer.SetExtensions()
+	out := answer.Marshal()
+	_, err = p.conn.Write(out)
+	if err != nil {
+		return hs.InfoHash, err
+	}
+	p.counters.sent(0, len(out), time.Now())
+
+	return hs.InfoHash, nil
+}
+
 func (p *Peer) SetReadDeadline(period time.Duration) {
 	p.conn.SetReadDeadline(time.Now().Add(period))
 }
 
+// KeepAlive makes writer send keep-alive after period without any message.
 func (p *Peer) KeepAlive(period time.Duration) {
-	p.keepAlivePeriod = period
-	p.keepAliveTicker = time.NewTicker(p.keepAlivePeriod)
-
-	go func() {
-		for range p.keepAliveTicker.C {
-			_, err := p.WriteKeepAlive()
-			if err != nil {
-				p.Close()
-			}
-		}
-	}()
+	p.writer.setKeepAlive(period)
 }
 
-func (p *Peer) SendInterested() error {
-	_, err := p.WriteMsg(protocol.IDInterested, nil)
-	if err != nil {
+// TrackPieces keeps bitfield of count pieces that peer has, updated by its
+// have and bitfield messages. Pieces that peer announces are checked with
+// want, and we are interested in peer while it has any wanted piece.
+func (p *Peer) TrackPieces(count int, want func(pi int) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pieces = bitfield.New(count)
+	p.wanted = bitfield.New(count)
+	p.wantedCount = 0
+	p.want = want
+}
+
+// Pieces returns copy of pieces that peer has, or nil if pieces are not
+// tracked. Copy is not updated by later messages of peer.
+func (p *Peer) Pieces() bitfield.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pieces == nil {
 		return nil
 	}
 
-	p.IsInteresting = true
-	return nil
+	return p.pieces.Clone()
 }
 
-func (p *Peer) SendNotInterested() error {
-	_, err := p.WriteMsg(protocol.IDNotInterested, nil)
-	if err != nil {
-		return nil
+// OnStateChange sets hook called with previous state after state changes,
+// so choker can react to peer interest. Hook must not block.
+func (p *Peer) OnStateChange(fn func(peer *Peer, old PeerState)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.onState = fn
+}
+
+func (p *Peer) State() PeerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state
+}
+
+// Choke stops serving requests of peer. Nothing is sent if peer is already
+// choked.
+func (p *Peer) Choke() error {
+	p.mu.Lock()
+	state := p.state
+	state.AmChoking = true
+	old, err := p.sendState(state, protocol.IDChoke)
+	p.mu.Unlock()
+
+	p.stateChanged(old)
+	return err
+}
+
+// Unchoke allows peer to request pieces. Nothing is sent if peer is already
+// unchoked.
+func (p *Peer) Unchoke() error {
+	p.mu.Lock()
+	state := p.state
+	state.AmChoking = false
+	old, err := p.sendState(state, protocol.IDUnchoke)
+	p.mu.Unlock()
+
+	p.stateChanged(old)
+	return err
+}
+
+// UpdateInterest checks every piece of peer with want again, such as after
+// priorities change, and sends interested or not interested if it changed.
+func (p *Peer) UpdateInterest() error {
+	p.mu.Lock()
+	p.countWanted()
+	p.mu.Unlock()
+
+	return p.sendInterest()
+}
+
+// Unwant stops counting piece as wanted after it was verified, and sends
+// not interested if peer has nothing else we want.
+func (p *Peer) Unwant(pi int) error {
+	p.mu.Lock()
+	if p.wanted != nil {
+		if wanted, _ := p.wanted.Get(pi); wanted {
+			p.wanted.Clear(pi)
+			p.wantedCount--
+		}
 	}
+	p.mu.Unlock()
 
-	p.IsInteresting = false
-	return nil
+	return p.sendInterest()
 }
 
-func (p *Peer) RecvRequest(index, offset, length int) error {
-	req := p.Requests[0]
+// countWanted recounts wanted pieces of peer. Caller must hold mu.
+func (p *Peer) countWanted() {
+	if p.pieces == nil {
+		return
+	}
+
+	p.wanted = bitfield.New(p.pieces.Size())
+	p.wantedCount = 0
+	p.pieces.Range(func(pi int, has bool) bool {
+		if has && p.want(pi) {
+			p.wanted.Set(pi)
+			p.wantedCount++
+		}
 
-	if req[0] != index {
-		return errors.New("invalid index")
+		return true
+	})
+}
+
+// sendInterest sends interested or not interested if whether peer has
+// wanted pieces changed.
+func (p *Peer) sendInterest() error {
+	p.mu.Lock()
+	state := p.state
+	state.AmInterested = p.wantedCount > 0
+
+	id := protocol.IDNotInterested
+	if state.AmInterested {
+		id = protocol.IDInterested
 	}
-	if req[1]*MaxBlockLength != offset {
-		return errors.New("invalid offset")
+
+	old, err := p.sendState(state, id)
+	p.mu.Unlock()
+
+	p.stateChanged(old)
+	return err
+}
+
+// sendState replaces state and sends message announcing it, unless state
+// did not change. It returns previous state. Caller must hold mu.
+func (p *Peer) sendState(state PeerState, id protocol.MessageID) (PeerState, error) {
+	old := p.state
+	if state == old {
+		return old, nil
 	}
-	if req[2] != length {
-		return errors.New("invalid length")
+
+	p.state = state
+	_, err := p.WriteMsg(id, nil)
+	return old, err
+}
+
+// recvState applies message of peer to its side of state and to its
+// pieces. Interest is updated when pieces change, checking only the new
+// piece on have.
+func (p *Peer) recvState(msg *protocol.Message) error {
+	if msg.KeepAlive {
+		return nil
 	}
 
-	// TEMP: Fix for cancelled requests, BUT we still process them in our client
-	if len(p.Cancelled) != 0 {
-		if p.Cancelled[0][0] != req[0] && p.Cancelled[0][1] != req[1] && p.Cancelled[0][2] != req[2] {
-			p.Requests = p.Requests[1:]
+	p.mu.Lock()
+	old := p.state
+	changed := false
+
+	var err error
+	switch msg.ID {
+	case protocol.IDChoke:
+		p.state.PeerChoking = true
+	case protocol.IDUnchoke:
+		p.state.PeerChoking = false
+	case protocol.IDInterested:
+		p.state.PeerInterested = true
+	case protocol.IDNotInterested:
+		p.state.PeerInterested = false
+	case protocol.IDHave:
+		if p.pieces != nil {
+			pi := int(msg.Payload.Have())
+
+			var has bool
+			has, err = p.pieces.Get(pi)
+			if err == nil && !has {
+				p.pieces.Set(pi)
+				if p.want(pi) {
+					p.wanted.Set(pi)
+					p.wantedCount++
+				}
+				changed = true
+			}
 		}
-		p.Cancelled = p.Cancelled[1:]
+	case protocol.IDBitfield:
+		if p.pieces != nil {
+			err = p.pieces.Replace(msg.Payload)
+			if err == nil {
+				p.countWanted()
+				changed = true
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("bitfield: %w", err)
+	}
+
+	p.stateChanged(old)
+
+	if changed {
+		return p.sendInterest()
 	}
 
-	p.Requests = p.Requests[1:]
 	return nil
 }
 
+// stateChanged runs state hook if state differs from old.
+func (p *Peer) stateChanged(old PeerState) {
+	p.mu.Lock()
+	state, fn := p.state, p.onState
+	p.mu.Unlock()
+
+	if fn != nil && state != old {
+		fn(p, old)
+	}
+}
+
+// RecvRequest removes request answered by received block. Blocks may be
+// received in any order. Block that is not outstanding is counted as wasted
+// and returns ErrCancelledBlock or ErrUnrequestedBlock.
+func (p *Peer) RecvRequest(index, offset, length int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	req := BlockRequest{Index: index, Offset: offset, Length: length}
+
+	if sent, ok := p.requests[req]; ok {
+		delete(p.requests, req)
+		p.snubbed = false
+		now := time.Now()
+		p.pipeline.received(length, sent, now, p.counters.downloadRate(now))
+		return nil
+	}
+
+	p.Wasted += length
+
+	if _, ok := p.cancelled[req]; ok {
+		delete(p.cancelled, req)
+		return ErrCancelledBlock
+	}
+
+	return ErrUnrequestedBlock
+}
+
 func (p *Peer) SendRequest(index, offset, length int) error {
-	req := protocol.Request{Index: uint32(index), Offset: uint32(offset), Length: uint32(length)}
+	req, err := protocol.NewRequest(int64(index), int64(offset), int64(length))
+	if err != nil {
+		return err
+	}
 
-	p.Requests = append(p.Requests, []int{index, offset / MaxBlockLength, length})
-	_, err := p.WriteMsg(protocol.IDRequest, req.Marshal())
+	p.mu.Lock()
+	p.requests[BlockRequest{Index: index, Offset: offset, Length: length}] = time.Now()
+	p.mu.Unlock()
+
+	_, err = p.WriteMsg(protocol.IDRequest, req.Marshal())
 	if err != nil {
 		return err
 	}
@@ -124,82 +420,339 @@ func (p *Peer) SendRequest(index, offset, length int) error {
 }
 
 func (p *Peer) SendCancel(index, offset, length int) error {
-	req := protocol.Request{Index: uint32(index), Offset: uint32(offset), Length: uint32(length)}
+	req, err := protocol.NewRequest(int64(index), int64(offset), int64(length))
+	if err != nil {
+		return err
+	}
 
-	_, err := p.WriteMsg(protocol.IDCancel, req.Marshal())
+	_, err = p.WriteMsg(protocol.IDCancel, req.Marshal())
 	if err != nil {
 		return err
 	}
 
-	for _, req := range p.Requests {
-		if req[0] != index {
-			continue
-		}
-		if req[1]*MaxBlockLength != offset {
-			continue
-		}
-		if req[2] != length {
-			continue
-		}
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		p.Cancelled = append(p.Cancelled, req)
-		break
+	// Peer may have sent block before receiving cancel
+	key := BlockRequest{Index: index, Offset: offset, Length: length}
+	if _, ok := p.requests[key]; ok {
+		delete(p.requests, key)
+		p.cancelled[key] = struct{}{}
 	}
 
 	return nil
 }
 
+// Requests returns outstanding requests, oldest first.
+func (p *Peer) Requests() []BlockRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reqs := make([]BlockRequest, 0, len(p.requests))
+	for req := range p.requests {
+		reqs = append(reqs, req)
+	}
+
+	slices.SortFunc(reqs, func(a, b BlockRequest) int {
+		return p.requests[a].Compare(p.requests[b])
+	})
+
+	return reqs
+}
+
+// ClearRequests forgets outstanding and cancelled requests, as choking peer
+// discards them. It returns requests that were outstanding, oldest first.
+func (p *Peer) ClearRequests() []BlockRequest {
+	reqs := p.Requests()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.requests = map[BlockRequest]time.Time{}
+	p.cancelled = map[BlockRequest]struct{}{}
+
+	return reqs
+}
+
+// ExpireRequests returns outstanding requests that were sent before now
+// minus RequestTimeout for peer rate in bytes per second. Peer is snubbed
+// if any request expired, until it sends requested block again.
+func (p *Peer) ExpireRequests(now time.Time, rate float64) []BlockRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	expired := []BlockRequest{}
+	for req, sent := range p.requests {
+		if now.Sub(sent) >= RequestTimeout(req.Length, rate) {
+			expired = append(expired, req)
+		}
+	}
+
+	if len(expired) != 0 {
+		p.snubbed = true
+	}
+
+	return expired
+}
+
+// RequestTimeout returns how long block of given length may take at peer
+// rate in bytes per second. Unknown rate gets MaxRequestTimeout.
+func RequestTimeout(length int, rate float64) time.Duration {
+	if rate <= 0 {
+		return MaxRequestTimeout
+	}
+
+	timeout := time.Duration(RequestTimeoutFactor * float64(length) / rate * float64(time.Second))
+	if timeout < MinRequestTimeout {
+		return MinRequestTimeout
+	}
+	if timeout > MaxRequestTimeout {
+		return MaxRequestTimeout
+	}
+
+	return timeout
+}
+
+func (p *Peer) IsSnubbed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.snubbed
+}
+
+// SetRemoteMaxRequests limits outstanding requests to reqq value peer sent
+// in extension handshake.
+func (p *Peer) SetRemoteMaxRequests(reqq int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pipeline.setRemoteMax(reqq)
+}
+
+// QueueDepth returns number of requests that can be outstanding at once,
+// sized to bandwidth-delay product of peer link. Snubbed peer is limited
+// to SnubbedRequestCount requests.
+func (p *Peer) QueueDepth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.queueDepth()
+}
+
+func (p *Peer) queueDepth() int {
+	if p.snubbed {
+		return SnubbedRequestCount
+	}
+
+	return p.pipeline.depth
+}
+
+// IsRequestable reports whether another request can be sent to peer.
 func (p *Peer) IsRequestable() bool {
-	return len(p.Requests) < MaxRequestCountPerPeer && p.IsInteresting
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.requests) < p.queueDepth() && p.state.AmInterested && !p.state.PeerChoking
 }
 
 func (p *Peer) ReadMsg() (*protocol.Message, error) {
-	msg, err := protocol.UnmarshalMessage(p.conn)
+	msg, err := protocol.UnmarshalMessage(limitedReader{r: p.conn, peer: p})
 	if err != nil {
 		return nil, err
 	}
 
 	p.conn.SetReadDeadline(time.Time{})
 
-	// fmt.Printf("%s READ: %s\n", p.conn.RemoteAddr().String(), msg.String())
+	payload, proto := messageSize(msg)
+	p.counters.recv(payload, proto, time.Now())
+
+	err = p.recvState(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !msg.KeepAlive && msg.ID == protocol.IDExtended {
+		err = p.recvExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.trace("read", msg, payload+proto)
 
 	return msg, nil
 }
 
+// WriteMsg queues message for writing without blocking. It returns
+// ErrWriteQueueFull if peer does not keep up with messages, and error of
+// failed write once connection is closed.
 func (p *Peer) WriteMsg(id protocol.MessageID, payload []byte) (int, error) {
-	nmsg := &protocol.Message{ID: id, Payload: payload}
-	wb, err := p.conn.Write(nmsg.Marshal())
-	if err != nil {
-		return wb, err
+	return p.writer.enqueue(&protocol.Message{ID: id, Payload: payload})
+}
+
+func (p *Peer) WriteKeepAlive() (int, error) {
+	return p.writer.enqueue(&protocol.Message{KeepAlive: true})
+}
+
+// messageSize returns number of piece data bytes and other bytes of message
+// on the wire.
+func messageSize(msg *protocol.Message) (int, int) {
+	// Length prefix and message
+	size := 4 + int(msg.Len())
+
+	payload := 0
+	if !msg.KeepAlive && msg.ID == protocol.IDPiece && len(msg.Payload) > 8 {
+		// Index and offset precede block data
+		payload = len(msg.Payload) - 8
 	}
-	p.keepAliveTicker.Reset(p.keepAlivePeriod)
 
-	// fmt.Printf("%s WRITE: %s\n", p.conn.RemoteAddr().String(), nmsg.String())
+	return payload, size - payload
+}
 
-	return wb, nil
+// SetSharedLimits sets bandwidth limits shared with other peers, such as
+// torrent and global limit, that apply in addition to peer Limit.
+func (p *Peer) SetSharedLimits(limits ...*BandwidthLimit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.shared = limits
 }
 
-func (p *Peer) WriteKeepAlive() (int, error) {
-	nmsg := &protocol.Message{KeepAlive: true}
-	return p.conn.Write(nmsg.Marshal())
+func (p *Peer) bandwidthLimits() []*BandwidthLimit {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]*BandwidthLimit{p.Limit}, p.shared...)
 }
 
-func (p *Peer) WriteUnchoke() (int, error) {
-	return p.WriteMsg(protocol.IDUnchoke, nil)
+// IsLocal reports whether peer is on loopback or local network.
+func (p *Peer) IsLocal() bool {
+	return isLocalAddr(p.conn.RemoteAddr())
+}
+
+// Stats returns snapshot of peer state and transfer.
+func (p *Peer) Stats() PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PeerStats{
+		Addr:          p.String(),
+		TransferStats: p.counters.snapshot(time.Now()),
+		QueueDepth:    p.queueDepth(),
+		Requests:      len(p.requests),
+		Wasted:        p.Wasted,
+		Snubbed:       p.snubbed,
+		PeerState:     p.state,
+	}
+}
+
+// DownloadRate returns payload download rate of peer in bytes per second.
+// It is the rate used for request timeouts, queue depth and picking.
+func (p *Peer) DownloadRate() float64 {
+	return p.counters.downloadRate(time.Now())
 }
 
 func (p *Peer) WriteHave(index int) (int, error) {
-	payload := protocol.Have(index).Marshal()
-	return p.WriteMsg(protocol.IDHave, payload)
+	have, err := protocol.NewHave(int64(index))
+	if err != nil {
+		return 0, err
+	}
+
+	return p.WriteMsg(protocol.IDHave, have.Marshal())
 }
 
 func (p *Peer) String() string {
 	return p.conn.RemoteAddr().String()
 }
 
-func (p *Peer) Close() error {
-	if p.keepAliveTicker != nil {
-		p.keepAliveTicker.Stop()
+func (p *Peer) setRemote(hs *protocol.Handshake) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.id = hs.PeerID
+	p.extensions = hs.SupportsExtensions()
+}
+
+// SupportsExtensions reports if peer advertised extension protocol in
+// handshake.
+func (p *Peer) SupportsExtensions() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.extensions
+}
+
+// SendExtHandshake sends extension handshake. No extension messages are
+// supported, handshake only tells peer client name.
+func (p *Peer) SendExtHandshake() error {
+	payload, err := (&protocol.ExtHandshake{M: map[string]int{}, V: "gobt"}).Marshal()
+	if err != nil {
+		return err
+	}
+
+	_, err = p.WriteMsg(protocol.IDExtended, payload)
+	return err
+}
+
+// recvExtended applies extension handshake of peer. Other extended messages
+// are ignored, as none are advertised.
+func (p *Peer) recvExtended(msg *protocol.Message) error {
+	hs, err := protocol.UnmarshalExtHandshake(msg.Payload)
+	if errors.Is(err, protocol.ErrNotExtHandshake) {
+		return nil
 	}
-	return p.conn.Close()
+	if err != nil {
+		return err
+	}
+
+	if hs.Reqq > 0 {
+		p.SetRemoteMaxRequests(hs.Reqq)
+	}
+
+	return nil
+}
+
+// ID returns peer ID received in handshake.
+func (p *Peer) ID() [20]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.id
+}
+
+// ClientName returns client and version encoded in Azureus-style peer ID,
+// such as "qB4650", or "unknown" for other peer IDs.
+func (p *Peer) ClientName() string {
+	id := p.ID()
+	if id[0] != '-' || id[7] != '-' {
+		return "unknown"
+	}
+
+	return string(id[1:7])
+}
+
+// SetLogger sets logger of peer. Every message read and written is logged
+// at LevelTrace. Nothing is logged by default.
+func (p *Peer) SetLogger(logger *slog.Logger) {
+	p.logger.Store(logger)
+}
+
+func (p *Peer) trace(op string, msg *protocol.Message, length int) {
+	logger := p.logger.Load()
+	if !logger.Enabled(context.Background(), LevelTrace) {
+		return
+	}
+
+	logger.Log(context.Background(), LevelTrace, op, "msg", msg.String(), "length", length)
+}
+
+// Close closes connection and stops writer. Queued messages are dropped.
+func (p *Peer) Close() error {
+	err := net.ErrClosed
+	p.closeOnce.Do(func() {
+		close(p.writer.closed)
+		err = p.conn.Close()
+	})
+
+	return err
 }
@@ -0,0 +1,336 @@
+package gobt_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/edwces/gobt"
+	"github.com/edwces/gobt/protocol"
+)
+
+func TestPeerRecvRequest(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+
+	peer := gobt.NewPeer(conn)
+	peer.KeepAlive(time.Minute)
+	defer peer.Close()
+
+	for bi := 0; bi < 3; bi++ {
+		err := peer.SendRequest(1, bi*gobt.MaxBlockLength, gobt.MaxBlockLength)
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+	}
+
+	err := peer.SendCancel(1, 2*gobt.MaxBlockLength, gobt.MaxBlockLength)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	tests := []struct {
+		name   string
+		offset int
+		want   error
+	}{
+		{name: "out of order", offset: gobt.MaxBlockLength, want: nil},
+		{name: "in order", offset: 0, want: nil},
+		{name: "cancelled", offset: 2 * gobt.MaxBlockLength, want: gobt.ErrCancelledBlock},
+		{name: "duplicate", offset: 0, want: gobt.ErrUnrequestedBlock},
+	}
+
+	for _, test := range tests {
+		err := peer.RecvRequest(1, test.offset, gobt.MaxBlockLength)
+		if !errors.Is(err, test.want) {
+			t.Fatalf("%s: want %v, got %v", test.name, test.want, err)
+		}
+	}
+
+	if want := 2 * gobt.MaxBlockLength; peer.Wasted != want {
+		t.Fatalf("want %d wasted, got %d", want, peer.Wasted)
+	}
+
+	if reqs := peer.Requests(); len(reqs) != 0 {
+		t.Fatalf("want no requests, got %v", reqs)
+	}
+}
+
+func TestPeerExpireRequests(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+
+	peer := gobt.NewPeer(conn)
+	peer.KeepAlive(time.Minute)
+	defer peer.Close()
+
+	err := peer.SendRequest(1, 0, gobt.MaxBlockLength)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if expired := peer.ExpireRequests(time.Now(), 0); len(expired) != 0 {
+		t.Fatalf("want no expired requests, got %v", expired)
+	}
+
+	expired := peer.ExpireRequests(time.Now().Add(gobt.MaxRequestTimeout), 0)
+	if len(expired) != 1 {
+		t.Fatalf("want 1 expired request, got %v", expired)
+	}
+
+	if !peer.IsSnubbed() || peer.QueueDepth() != gobt.SnubbedRequestCount {
+		t.Fatalf("want snubbed peer at queue depth %d", gobt.SnubbedRequestCount)
+	}
+
+	err = peer.RecvRequest(1, 0, gobt.MaxBlockLength)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if peer.IsSnubbed() {
+		t.Fatalf("want peer not snubbed after receiving block")
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := map[string]struct {
+		rate float64
+		want time.Duration
+	}{
+		"unknown rate": {rate: 0, want: gobt.MaxRequestTimeout},
+		"fast peer":    {rate: 1 << 20, want: gobt.MinRequestTimeout},
+		"slow peer":    {rate: gobt.MaxBlockLength / 4, want: 4 * gobt.RequestTimeoutFactor * time.Second},
+		"stalled peer": {rate: 1, want: gobt.MaxRequestTimeout},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := gobt.RequestTimeout(gobt.MaxBlockLength, test.rate); got != test.want {
+				t.Fatalf("want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestPeerQueueDepth(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer remote.Close()
+
+	peer := gobt.NewPeer(conn)
+	defer peer.Close()
+
+	if depth := peer.QueueDepth(); depth != gobt.InitialRequestDepth {
+		t.Fatalf("want %d, got %d", gobt.InitialRequestDepth, depth)
+	}
+
+	peer.SetRemoteMaxRequests(3)
+	if depth := peer.QueueDepth(); depth != 3 {
+		t.Fatalf("want 3, got %d", depth)
+	}
+
+	// reqq of extension handshake limits depth too
+	payload, err := (&protocol.ExtHandshake{M: map[string]int{}, Reqq: 2}).Marshal()
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+	go remote.Write((&protocol.Message{ID: protocol.IDExtended, Payload: payload}).Marshal())
+
+	if _, err := peer.ReadMsg(); err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if depth := peer.QueueDepth(); depth != 2 {
+		t.Fatalf("want 2, got %d", depth)
+	}
+}
+
+func TestPeerStats(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer remote.Close()
+
+	peer := gobt.NewPeer(conn)
+	peer.KeepAlive(time.Minute)
+	defer peer.Close()
+
+	pm := gobt.NewPeersManager()
+	pm.Add(peer)
+
+	go func() {
+		// Read request, then answer it with a block
+		io.ReadFull(remote, make([]byte, 17))
+
+		block := protocol.Block{Index: 1, Offset: 0, Block: make([]byte, gobt.MaxBlockLength)}
+		msg := protocol.Message{ID: protocol.IDPiece, Payload: block.Marshal()}
+		remote.Write(msg.Marshal())
+	}()
+
+	err := peer.SendRequest(1, 0, gobt.MaxBlockLength)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	_, err = peer.ReadMsg()
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	want := gobt.TransferStats{Downloaded: gobt.MaxBlockLength, DownloadedProtocol: 13, UploadedProtocol: 17}
+
+	for name, got := range map[string]gobt.TransferStats{"peer": peer.Stats().TransferStats, "torrent": pm.Stats()} {
+		if got.Downloaded != want.Downloaded || got.DownloadedProtocol != want.DownloadedProtocol || got.Uploaded != want.Uploaded || got.UploadedProtocol != want.UploadedProtocol {
+			t.Fatalf("%s: want %+v, got %+v", name, want, got)
+		}
+
+		if got.LastRecv.IsZero() || got.LastSent.IsZero() {
+			t.Fatalf("%s: want activity timestamps, got %+v", name, got)
+		}
+	}
+
+	if stats := pm.PeerStats(); len(stats) != 1 || stats[0].Addr != peer.String() || stats[0].Requests != 1 {
+		t.Fatalf("want stats of 1 peer with 1 request, got %+v", stats)
+	}
+}
+
+func TestPeerWriteQueue(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer remote.Close()
+
+	peer := gobt.NewPeer(conn)
+	defer peer.Close()
+
+	// Remote does not read, so writes must not block until queue is full
+	var err error
+	n := 0
+	for ; n <= gobt.MaxControlQueue+1; n++ {
+		if _, err = peer.WriteHave(n); err != nil {
+			break
+		}
+	}
+
+	if !errors.Is(err, gobt.ErrWriteQueueFull) {
+		t.Fatalf("want ErrWriteQueueFull, got %v", err)
+	}
+
+	for i := 0; i < n; i++ {
+		msg, err := protocol.UnmarshalMessage(remote)
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+
+		if msg.ID != protocol.IDHave || int(msg.Payload.Have()) != i {
+			t.Fatalf("want have %d, got %s", i, msg.String())
+		}
+	}
+
+	peer.Close()
+	if _, err := peer.WriteHave(0); err == nil {
+		t.Fatalf("want err after close, got nil")
+	}
+}
+
+func TestPeerState(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer remote.Close()
+
+	peer := gobt.NewPeer(conn)
+	defer peer.Close()
+
+	// Only piece 3 is wanted
+	peer.TrackPieces(8, func(pi int) bool {
+		return pi == 3
+	})
+
+	changes := 0
+	peer.OnStateChange(func(peer *gobt.Peer, old gobt.PeerState) {
+		changes++
+	})
+
+	if want := (gobt.PeerState{AmChoking: true, PeerChoking: true}); peer.State() != want {
+		t.Fatalf("want %+v, got %+v", want, peer.State())
+	}
+
+	tests := []struct {
+		name string
+		recv *protocol.Message
+		want gobt.PeerState
+		// Whether interested is sent in response
+		interested bool
+	}{
+		{
+			name: "unchoke",
+			recv: &protocol.Message{ID: protocol.IDUnchoke},
+			want: gobt.PeerState{AmChoking: true},
+		},
+		{
+			name: "interested",
+			recv: &protocol.Message{ID: protocol.IDInterested},
+			want: gobt.PeerState{AmChoking: true, PeerInterested: true},
+		},
+		{
+			name: "unwanted bitfield",
+			recv: &protocol.Message{ID: protocol.IDBitfield, Payload: []byte{0b11000000}},
+			want: gobt.PeerState{AmChoking: true, PeerInterested: true},
+		},
+		{
+			name:       "wanted have",
+			recv:       &protocol.Message{ID: protocol.IDHave, Payload: []byte{0, 0, 0, 3}},
+			want:       gobt.PeerState{AmChoking: true, AmInterested: true, PeerInterested: true},
+			interested: true,
+		},
+		{
+			name: "choke",
+			recv: &protocol.Message{ID: protocol.IDChoke},
+			want: gobt.PeerState{AmChoking: true, AmInterested: true, PeerChoking: true, PeerInterested: true},
+		},
+	}
+
+	for _, test := range tests {
+		go remote.Write(test.recv.Marshal())
+
+		_, err := peer.ReadMsg()
+		if err != nil {
+			t.Fatalf("%s: want nil, got err: %s", test.name, err.Error())
+		}
+
+		if got := peer.State(); got != test.want {
+			t.Fatalf("%s: want %+v, got %+v", test.name, test.want, got)
+		}
+
+		if test.interested {
+			msg, err := protocol.UnmarshalMessage(remote)
+			if err != nil || msg.ID != protocol.IDInterested {
+				t.Fatalf("%s: want interested sent, got %v", test.name, msg)
+			}
+		}
+	}
+
+	if changes != 4 {
+		t.Fatalf("want 4 state changes, got %d", changes)
+	}
+
+	// Verified piece is no longer wanted from peer
+	if err := peer.Unwant(3); err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+	msg, err := protocol.UnmarshalMessage(remote)
+	if err != nil || msg.ID != protocol.IDNotInterested {
+		t.Fatalf("want not interested sent, got %v", msg)
+	}
+
+	// Unchoke is sent once
+	go io.Copy(io.Discard, remote)
+	for i := 0; i < 2; i++ {
+		err := peer.Unchoke()
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+	}
+
+	if peer.State().AmChoking || changes != 6 {
+		t.Fatalf("want unchoked peer after 6 state changes, got %+v after %d", peer.State(), changes)
+	}
+}
@@ -1,23 +1,135 @@
 package gobt
 
-import "sync"
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
 
 type PeersManager struct {
-	peers sync.Map
+	peers    sync.Map
+	counters transferCounters
+
+	limit       *BandwidthLimit
+	global      *BandwidthLimit
+	peerDown    int
+	peerUp      int
+	exemptLocal bool
+	mu          sync.Mutex
 }
 
 func NewPeersManager() *PeersManager {
-	return &PeersManager{peers: sync.Map{}}
+	return &PeersManager{peers: sync.Map{}, limit: NewBandwidthLimit(0, 0)}
 }
 
+// Add registers connected peer. Transfer of peer is counted in torrent
+// stats and limited by bandwidth limits from now on.
 func (pm *PeersManager) Add(peer *Peer) {
+	peer.counters.setParent(&pm.counters)
+
+	pm.mu.Lock()
+	pm.applyLimits(peer)
+	pm.mu.Unlock()
+
 	pm.peers.Store(peer.String(), peer)
 }
 
+// Limit returns bandwidth limit shared by all peers of torrent.
+func (pm *PeersManager) Limit() *BandwidthLimit {
+	return pm.limit
+}
+
+// SetGlobalLimit sets bandwidth limit shared with peers of other torrents.
+func (pm *PeersManager) SetGlobalLimit(limit *BandwidthLimit) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.global = limit
+	pm.rangePeers(pm.applyLimits)
+}
+
+// SetPeerLimit sets download and upload limit of every peer.
+func (pm *PeersManager) SetPeerLimit(download, upload int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.peerDown, pm.peerUp = download, upload
+	pm.rangePeers(pm.applyLimits)
+}
+
+// SetExemptLocal makes peers on local network bypass all bandwidth limits.
+func (pm *PeersManager) SetExemptLocal(exempt bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.exemptLocal = exempt
+	pm.rangePeers(pm.applyLimits)
+}
+
+func (pm *PeersManager) applyLimits(peer *Peer) {
+	if pm.exemptLocal && peer.IsLocal() {
+		peer.Limit.SetLimit(0, 0)
+		peer.SetSharedLimits()
+		return
+	}
+
+	peer.Limit.SetLimit(pm.peerDown, pm.peerUp)
+	peer.SetSharedLimits(pm.limit, pm.global)
+}
+
+func (pm *PeersManager) rangePeers(fn func(peer *Peer)) {
+	pm.peers.Range(func(key, value any) bool {
+		fn(value.(*Peer))
+		return true
+	})
+}
+
+// PeerRate returns download rate of connected peer, if it was measured.
+func (pm *PeersManager) PeerRate(peer string) (float64, bool) {
+	v, ok := pm.peers.Load(peer)
+	if !ok {
+		return 0, false
+	}
+
+	rate := v.(*Peer).DownloadRate()
+	return rate, rate > 0
+}
+
+// PeerRates returns measured download rates of connected peers.
+func (pm *PeersManager) PeerRates() []float64 {
+	rates := []float64{}
+	pm.rangePeers(func(peer *Peer) {
+		if rate := peer.DownloadRate(); rate > 0 {
+			rates = append(rates, rate)
+		}
+	})
+
+	return rates
+}
+
 func (pm *PeersManager) Remove(peer *Peer) {
 	pm.peers.Delete(peer.String())
 }
 
+// Stats returns transfer of all peers that were connected.
+func (pm *PeersManager) Stats() TransferStats {
+	return pm.counters.snapshot(time.Now())
+}
+
+// PeerStats returns snapshot of every connected peer, ordered by address.
+func (pm *PeersManager) PeerStats() []PeerStats {
+	stats := []PeerStats{}
+	pm.peers.Range(func(key, value any) bool {
+		stats = append(stats, value.(*Peer).Stats())
+		return true
+	})
+
+	slices.SortFunc(stats, func(a, b PeerStats) int { return strings.Compare(a.Addr, b.Addr) })
+	return stats
+}
+
 func (pm *PeersManager) Disconnect() {
 	pm.peers.Range(func(key, value any) bool {
 		value.(*Peer).Close()
@@ -42,20 +154,43 @@ func (pm *PeersManager) WriteHave(have int, peerID string) {
 	})
 }
 
-func (pm *PeersManager) WriteCancel(index int, offset int, length int, peerID string) {
+// UpdateInterest recomputes interest in every peer, such as after
+// priorities change.
+func (pm *PeersManager) UpdateInterest() {
 	pm.peers.Range(func(key, value any) bool {
 		peer := value.(*Peer)
 
-		if peer.String() == peerID {
-			return true
-		}
-
-		err := peer.SendCancel(index, offset, length)
+		err := peer.UpdateInterest()
 		if err != nil {
 			peer.Close()
-			return true
 		}
 
 		return true
 	})
 }
+
+// Unwant stops counting verified piece as wanted from every peer.
+func (pm *PeersManager) Unwant(pi int) {
+	pm.rangePeers(func(peer *Peer) {
+		err := peer.Unwant(pi)
+		if err != nil {
+			peer.Close()
+		}
+	})
+}
+
+// WriteCancel sends cancel for block to given peers.
+func (pm *PeersManager) WriteCancel(index int, offset int, length int, peerIDs []string) {
+	for _, peerID := range peerIDs {
+		value, ok := pm.peers.Load(peerID)
+		if !ok {
+			continue
+		}
+
+		peer := value.(*Peer)
+		err := peer.SendCancel(index, offset, length)
+		if err != nil {
+			peer.Close()
+		}
+	}
+}
@@ -2,7 +2,8 @@ package gobt
 
 import (
 	"errors"
-	"math"
+	"fmt"
+	"log/slog"
 	"math/rand"
 	"sync"
 	"time"
@@ -13,6 +14,7 @@ import (
 
 type PieceStatus int
 type BlockStatus int
+type Priority int
 
 const (
 	PieceInQueue PieceStatus = iota
@@ -24,91 +26,542 @@ const (
 	BlockPending
 	BlockDone
 
-	MaxBlockLength        = 16000
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+
 	RandomPieceEndCounter = 5
+	MaxDeadlineDuplicates = 2
+	MaxEndgameDuplicates  = 2
+)
+
+// PickMode is how picker chooses new pieces.
+type PickMode int
+
+const (
+	// First pieces are chosen at random to have something to share quickly
+	PickRandom PickMode = iota
+	PickRarest
+	PickSequential
+	// Every piece was requested and pending blocks are duplicated
+	PickEndgame
+	// Strategy set by SetStrategy is not one of the built in strategies
+	PickCustom
 )
 
-func CalcPieceCount(tSize, pMaxSize int) int {
-	return int(math.Ceil((float64(tSize) / float64(pMaxSize))))
+var pickModeNames = map[PickMode]string{
+	PickRandom:     "random",
+	PickRarest:     "rarest",
+	PickSequential: "sequential",
+	PickEndgame:    "endgame",
+	PickCustom:     "custom",
+}
+
+func (m PickMode) String() string {
+	return pickModeNames[m]
 }
 
-func CalcBlockCount(tSize, pMaxSize, pIndex int) int {
-	pSize := math.Min(float64(pMaxSize), float64(tSize)-float64(pMaxSize)*float64(pIndex))
-	return int(math.Ceil((float64(pSize) / float64(MaxBlockLength))))
+// PeerRates reports download rates of connected peers in bytes per second.
+// Peers that are not connected or whose rate is not measured yet are absent.
+type PeerRates interface {
+	PeerRate(peer string) (float64, bool)
+	PeerRates() []float64
 }
 
+// ErrMemoryBudget is returned by Pick when no new piece can be started
+// without exceeding memory budget.
+var ErrMemoryBudget = errors.New("memory budget exhausted")
+
 type Block struct {
 	status BlockStatus
 
-	peers []string
+	peers     []string
+	requested map[string]time.Time
 }
 
 type Piece struct {
 	blocks []*Block
 	status PieceStatus
 
-	availability int
+	priority Priority
+	verified chan struct{}
+	deadline time.Time
+}
+
+type window struct {
+	start int
+	end   int
 }
 
 type Picker struct {
-	counter        int
-	length         int
-	maxPieceLength int
+	counter int
+	layout  Layout
+
+	pieces map[int]*Piece
+	order  *pieceOrder
+	rand   *rand.Rand
+	budget *MemoryBudget
+
+	windows  map[int]window
+	windowID int
 
-	pieces  map[int]*Piece
-	ordered []int
-	rand    *rand.Rand
+	strategy  Strategy
+	deadlines []int
+	rates     PeerRates
+
+	files          []FileEntry
+	filePriorities []Priority
+
+	logger   *slog.Logger
+	lastMode PickMode
+
+	discard func(pi int)
 
 	sync.Mutex
 }
 
-// NewPicker creates picker with pieces to pick from.
-func NewPicker(length, maxPieceLength int) *Picker {
+// NewPicker creates picker with pieces of layout to pick from.
+func NewPicker(layout Layout) *Picker {
 	rand := rand.New(rand.NewSource(time.Now().Unix()))
 
-	count := CalcPieceCount(length, maxPieceLength)
-	ordered := make([]int, count)
+	order := newPieceOrder(layout.PieceCount())
 
-	for i := 0; i < count; i++ {
-		ordered[i] = i
-	}
+	return &Picker{layout: layout, order: order, pieces: map[int]*Piece{}, windows: map[int]window{}, strategy: DefaultStrategy{}, rand: rand, logger: discardLogger}
+}
 
-	return &Picker{length: length, maxPieceLength: maxPieceLength, ordered: ordered, pieces: map[int]*Piece{}, rand: rand}
+// SetLogger sets logger that changes of pick mode are logged to.
+func (p *Picker) SetLogger(logger *slog.Logger) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.logger = logger
+}
+
+// Mode returns how picker currently chooses new pieces.
+func (p *Picker) Mode() PickMode {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.mode()
+}
+
+func (p *Picker) mode() PickMode {
+	switch p.strategy.(type) {
+	case DefaultStrategy:
+		if p.order.remaining() == 0 {
+			return PickEndgame
+		}
+		if p.counter < RandomPieceEndCounter {
+			return PickRandom
+		}
+		return PickRarest
+	case SequentialStrategy:
+		if p.order.remaining() == 0 {
+			return PickEndgame
+		}
+		return PickSequential
+	default:
+		return PickCustom
+	}
 }
 
 func (p *Picker) SetRandSeed(seed int64) {
 	p.rand.Seed(seed)
 }
 
+// SetMemoryBudget limits how many pieces can be started at once. Reserved
+// memory is released by Storage once piece data is no longer buffered.
+func (p *Picker) SetMemoryBudget(budget *MemoryBudget) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.budget = budget
+}
+
 // Pick gets a new block from pieces that are available in bitfield.
 func (p *Picker) Pick(have bitfield.Bitfield, peer string) (int, int, error) {
 	p.Lock()
 	defer p.Unlock()
 
-	if len(p.ordered) == 0 {
-		return p.pickEndgame(have, peer)
+	pi, bi, err := p.pickDeadline(have, peer)
+	if err == nil || errors.Is(err, ErrMemoryBudget) {
+		return pi, bi, err
+	}
+
+	pi, bi, err = p.pickWindow(have, peer)
+	if err == nil || errors.Is(err, ErrMemoryBudget) {
+		return pi, bi, err
+	}
+
+	if mode := p.mode(); mode != p.lastMode {
+		p.logger.Debug("pick mode changed", "from", p.lastMode.String(), "to", mode.String())
+		p.lastMode = mode
+	}
+
+	pi, err = p.strategy.Choose(have, peer, pickerState{p})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if pi < 0 || pi >= p.layout.PieceCount() {
+		return 0, 0, fmt.Errorf("strategy chose piece %d out of range", pi)
 	}
 
-	pi, bi, err := p.pickStrict(have, peer)
-	if err == nil {
+	if has, _ := have.Get(pi); !has {
+		return 0, 0, fmt.Errorf("strategy chose piece %d not available from peer", pi)
+	}
+
+	return p.pickFromPiece(pi, peer)
+}
+
+// SetStrategy replaces strategy used to choose pieces.
+func (p *Picker) SetStrategy(strategy Strategy) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.strategy = strategy
+}
+
+// pickFromPiece picks next queued block of piece, or duplicates one of its
+// pending blocks.
+func (p *Picker) pickFromPiece(pi int, peer string) (int, int, error) {
+	piece := p.getPiece(pi)
+
+	if piece.priority == PrioritySkip {
+		return 0, 0, errors.New("Piece is skipped")
+	}
+
+	switch piece.status {
+	case PieceInQueue:
+		if !p.reserve(pi) {
+			return 0, 0, ErrMemoryBudget
+		}
+		return pi, p.pickNextBlock(piece, pi, peer), nil
+	case PieceInProgress:
+		return pi, p.pickNextBlock(piece, pi, peer), nil
+	case PiecePending:
+		bi, err := p.pickPendingBlock(piece, pi, peer)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		p.requestBlock(piece.blocks[bi], peer)
 		return pi, bi, nil
 	}
 
-	if p.counter < RandomPieceEndCounter {
-		return p.pickRandom(have, peer)
+	return 0, 0, errors.New("Piece is done")
+}
+
+// SetFiles sets files of torrent content so priorities can be set per file.
+func (p *Picker) SetFiles(files []FileEntry) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.files = files
+	p.filePriorities = make([]Priority, len(files))
+	for i := range p.filePriorities {
+		p.filePriorities[i] = PriorityNormal
+	}
+}
+
+// SetFilePriority sets priority of file pieces. Piece shared by several
+// files gets the highest priority of these files.
+func (p *Picker) SetFilePriority(fi int, priority Priority) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.filePriorities[fi] = priority
+
+	file := p.files[fi]
+	if file.Length == 0 {
+		return
 	}
 
-	return p.pickRarest(have, peer)
+	first := p.layout.PieceAt(file.Offset)
+	last := p.layout.PieceAt(file.Offset + file.Length - 1)
+
+	for pi := first; pi <= last; pi++ {
+		start := p.layout.PieceOffset(pi)
+		end := start + int64(p.layout.PieceSize(pi))
+		highest := PrioritySkip
+
+		for i, f := range p.files {
+			if f.Length == 0 || f.Offset >= end || f.Offset+f.Length <= start {
+				continue
+			}
+
+			if p.filePriorities[i] > highest {
+				highest = p.filePriorities[i]
+			}
+		}
+
+		p.setPriority(pi, highest)
+	}
 }
 
-func (p *Picker) IncrementPieceAvailability(pi int) {
+func (p *Picker) FilePriority(fi int) Priority {
+	p.Lock()
+	defer p.Unlock()
+
+	if fi >= len(p.filePriorities) {
+		return PriorityNormal
+	}
+
+	return p.filePriorities[fi]
+}
+
+func (p *Picker) SetPiecePriority(pi int, priority Priority) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.setPriority(pi, priority)
+}
+
+// setPriority changes piece priority. Skipped pieces are kept out of order
+// so they are never started.
+func (p *Picker) setPriority(pi int, priority Priority) {
+	piece := p.getPiece(pi)
+	piece.priority = priority
+
+	// Skipped piece is never finished, so started piece is reset and its
+	// memory reservation released
+	if priority == PrioritySkip && (piece.status == PieceInProgress || piece.status == PiecePending) {
+		p.discardPiece(pi, piece)
+	}
+
+	p.track(pi, piece)
+}
+
+// DiscardStarted resets every started piece whose blocks are not all
+// received, releasing its memory reservation and partial data, such as when
+// torrent is closed.
+func (p *Picker) DiscardStarted() {
+	p.Lock()
+	defer p.Unlock()
+
+	for pi, piece := range p.pieces {
+		if piece.status == PieceInProgress || piece.status == PiecePending {
+			p.discardPiece(pi, piece)
+			p.track(pi, piece)
+		}
+	}
+}
+
+// discardPiece puts started piece back to queue, releases its reservation
+// and drops its data.
+func (p *Picker) discardPiece(pi int, piece *Piece) {
+	piece.status = PieceInQueue
+	piece.blocks = p.newBlocksForPiece(pi)
+
+	if p.budget != nil {
+		p.budget.Release(p.layout.PieceSize(pi))
+	}
+	if p.discard != nil {
+		p.discard(pi)
+	}
+}
+
+// OnDiscard sets function called with started piece that was reset because
+// it was skipped or discarded. Picker releases memory reservation of piece, fn should
+// drop its partial data.
+func (p *Picker) OnDiscard(fn func(pi int)) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.discard = fn
+}
+
+// Progress returns number of verified pieces and number of all pieces.
+func (p *Picker) Progress() (int, int) {
+	p.Lock()
+	defer p.Unlock()
+
+	done := 0
+	for _, piece := range p.pieces {
+		if p.isVerified(piece) {
+			done++
+		}
+	}
+
+	return done, p.layout.PieceCount()
+}
+
+// WantedProgress returns number of verified and all pieces that are not skipped.
+func (p *Picker) WantedProgress() (int, int) {
+	p.Lock()
+	defer p.Unlock()
+
+	done, wanted := 0, p.layout.PieceCount()
+	for _, piece := range p.pieces {
+		if piece.priority == PrioritySkip {
+			wanted--
+		} else if p.isVerified(piece) {
+			done++
+		}
+	}
+
+	return done, wanted
+}
+
+// Left returns number of bytes in pieces that are not verified yet.
+func (p *Picker) Left() int64 {
+	p.Lock()
+	defer p.Unlock()
+
+	left := p.layout.Length
+	for pi, piece := range p.pieces {
+		if p.isVerified(piece) {
+			left -= int64(p.layout.PieceSize(pi))
+		}
+	}
+
+	return left
+}
+
+// IsWanted reports whether piece is not skipped and not verified yet.
+func (p *Picker) IsWanted(pi int) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	// Pieces without state were never skipped or started
+	piece, ok := p.pieces[pi]
+	return !ok || piece.priority != PrioritySkip && !p.isVerified(piece)
+}
+
+func (p *Picker) isVerified(piece *Piece) bool {
+	select {
+	case <-piece.verified:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetSequential makes picker start new pieces in index order instead of
+// random and rarest first.
+func (p *Picker) SetSequential(sequential bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if sequential {
+		p.strategy = SequentialStrategy{}
+	} else {
+		p.strategy = DefaultStrategy{}
+	}
+}
+
+// SetPieceDeadline marks piece as needed within given duration. Pieces with
+// deadline are picked before any other piece, only by peers that are not
+// slower than average, and their blocks are requested from more than one
+// peer once the deadline is at risk.
+func (p *Picker) SetPieceDeadline(pi int, within time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	piece := p.getPiece(pi)
+	select {
+	case <-piece.verified:
+		return
+	default:
+	}
+
+	if piece.deadline.IsZero() {
+		p.deadlines = append(p.deadlines, pi)
+	}
+	piece.deadline = time.Now().Add(within)
+
+	slices.SortFunc(p.deadlines, func(a, b int) int {
+		return p.getPiece(a).deadline.Compare(p.getPiece(b).deadline)
+	})
+}
+
+func (p *Picker) ClearPieceDeadline(pi int) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.clearDeadline(pi)
+}
+
+func (p *Picker) clearDeadline(pi int) {
+	piece := p.getPiece(pi)
+	if piece.deadline.IsZero() {
+		return
+	}
+
+	piece.deadline = time.Time{}
+	p.deadlines = slices.DeleteFunc(p.deadlines, func(e int) bool { return e == pi })
+}
+
+// AddWindow registers a range of pieces that is picked in order before any
+// other piece. It returns id used to move or remove the window.
+func (p *Picker) AddWindow(start, end int) int {
+	p.Lock()
+	defer p.Unlock()
+
+	p.windowID++
+	p.windows[p.windowID] = window{start: start, end: end}
+	return p.windowID
+}
+
+func (p *Picker) SetWindow(id, start, end int) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.windows[id] = window{start: start, end: end}
+}
+
+func (p *Picker) RemoveWindow(id int) {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.windows, id)
+}
+
+// MarkPieceVerified records that piece passed hash check and was stored.
+func (p *Picker) MarkPieceVerified(pi int) {
 	p.Lock()
 	defer p.Unlock()
 
 	piece := p.getPiece(pi)
-	piece.availability++
+	select {
+	case <-piece.verified:
+	default:
+		close(piece.verified)
+	}
 
-	p.update()
+	p.clearDeadline(pi)
+}
+
+// Unverify puts verified piece back to queue, so it is downloaded again.
+func (p *Picker) Unverify(pi int) {
+	p.Lock()
+	defer p.Unlock()
+
+	piece := p.getPiece(pi)
+	if !p.isVerified(piece) {
+		return
+	}
+
+	piece.status = PieceInQueue
+	piece.blocks = p.newBlocksForPiece(pi)
+	piece.verified = make(chan struct{})
+	p.track(pi, piece)
+}
+
+// PieceVerified returns channel that is closed once piece is verified.
+func (p *Picker) PieceVerified(pi int) <-chan struct{} {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.getPiece(pi).verified
+}
+
+func (p *Picker) IncrementPieceAvailability(pi int) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.order.increment(pi)
 }
 
 func (p *Picker) DecrementAvailability(have bitfield.Bitfield) {
@@ -120,12 +573,9 @@ func (p *Picker) DecrementAvailability(have bitfield.Bitfield) {
 			return true
 		}
 
-		piece := p.getPiece(i)
-		piece.availability--
+		p.order.decrement(i)
 		return true
 	})
-
-	p.update()
 }
 
 func (p *Picker) IncrementAvailability(have bitfield.Bitfield) {
@@ -137,25 +587,73 @@ func (p *Picker) IncrementAvailability(have bitfield.Bitfield) {
 			return true
 		}
 
-		piece := p.getPiece(i)
-		piece.availability++
+		p.order.increment(i)
 		return true
 	})
-
-	p.update()
 }
 
-func (p *Picker) MarkBlockDone(pi int, bi int, peer string) {
+// MarkBlockDone records that block was received from peer. It returns other
+// peers that still have the block requested and should be sent cancel.
+func (p *Picker) MarkBlockDone(pi int, bi int, peer string) []string {
 	p.Lock()
 	defer p.Unlock()
 
 	piece := p.getPiece(pi)
-	piece.blocks[bi].status = BlockDone
-	piece.blocks[bi].peers = slices.DeleteFunc(piece.blocks[bi].peers, func(e string) bool { return e == peer })
+	block := piece.blocks[bi]
+	block.status = BlockDone
+	block.peers = slices.DeleteFunc(block.peers, func(e string) bool { return e == peer })
+
+	cancel := block.peers
+	block.peers = nil
+	block.requested = nil
 
 	if p.isPieceDone(piece) {
 		piece.status = PieceDone
 	}
+
+	return cancel
+}
+
+// SetPeerRates sets source of peer download rates used to pick fast peers
+// for deadline and endgame blocks. Without it no rates are known.
+func (p *Picker) SetPeerRates(rates PeerRates) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.rates = rates
+}
+
+func (p *Picker) peerRate(peer string) (float64, bool) {
+	if p.rates == nil {
+		return 0, false
+	}
+
+	return p.rates.PeerRate(peer)
+}
+
+// isFastPeer reports whether peer rate is at least average of known rates.
+// Peers without measured rate are only considered fast if no rates are known.
+func (p *Picker) isFastPeer(peer string) bool {
+	if p.rates == nil {
+		return true
+	}
+
+	rates := p.rates.PeerRates()
+	if len(rates) == 0 {
+		return true
+	}
+
+	rate, ok := p.rates.PeerRate(peer)
+	if !ok {
+		return false
+	}
+
+	sum := 0.0
+	for _, r := range rates {
+		sum += r
+	}
+
+	return rate >= sum/float64(len(rates))
 }
 
 func (p *Picker) isPieceDone(piece *Piece) bool {
@@ -168,20 +666,26 @@ func (p *Picker) isPieceDone(piece *Piece) bool {
 	return true
 }
 
-func (p *Picker) IsPieceDone(pi int) bool {
+// IsBlockWanted reports if block of started piece was not received yet.
+// Blocks of pieces that are done or were reset are not wanted.
+func (p *Picker) IsBlockWanted(pi int, bi int) bool {
 	p.Lock()
 	defer p.Unlock()
 
 	piece := p.getPiece(pi)
-	return piece.status == PieceDone
+	if piece.status != PieceInProgress && piece.status != PiecePending {
+		return false
+	}
+
+	return piece.blocks[bi].status != BlockDone
 }
 
-func (p *Picker) IsBlockDownloaded(pi int, bi int) bool {
+func (p *Picker) IsPieceDone(pi int) bool {
 	p.Lock()
 	defer p.Unlock()
 
 	piece := p.getPiece(pi)
-	return len(piece.blocks[bi].peers) != 0
+	return piece.status == PieceDone
 }
 
 func (p *Picker) FailPendingPiece(pi int) {
@@ -191,9 +695,7 @@ func (p *Picker) FailPendingPiece(pi int) {
 	piece := p.getPiece(pi)
 	piece.status = PieceInQueue
 	piece.blocks = p.newBlocksForPiece(pi)
-
-	p.ordered = append(p.ordered, pi)
-	p.update()
+	p.track(pi, piece)
 }
 
 func (p *Picker) FailPendingBlock(pi int, bi int, peer string) {
@@ -201,64 +703,111 @@ func (p *Picker) FailPendingBlock(pi int, bi int, peer string) {
 	defer p.Unlock()
 
 	piece := p.getPiece(pi)
-	piece.blocks[bi].status = BlockInQueue
-	piece.blocks[bi].peers = slices.DeleteFunc(piece.blocks[bi].peers, func(e string) bool { return e == peer })
+	block := piece.blocks[bi]
+	block.peers = slices.DeleteFunc(block.peers, func(e string) bool { return e == peer })
+	delete(block.requested, peer)
+
+	// Block is still requested from other peers in endgame
+	if block.status == BlockDone || len(block.peers) != 0 {
+		return
+	}
+
+	block.status = BlockInQueue
 
 	if piece.status == PiecePending {
 		piece.status = PieceInProgress
-		p.ordered = append(p.ordered, pi)
-		p.update()
+		p.track(pi, piece)
 	}
 }
 
-func (p *Picker) pickStrict(have bitfield.Bitfield, peer string) (int, int, error) {
-	for _, pi := range p.ordered {
+// pickDeadline picks blocks of pieces with deadline, earliest first. Block
+// that is already requested is duplicated when its deadline is at risk.
+func (p *Picker) pickDeadline(have bitfield.Bitfield, peer string) (int, int, error) {
+	if len(p.deadlines) == 0 || !p.isFastPeer(peer) {
+		return 0, 0, errors.New("No piece found")
+	}
+
+	now := time.Now()
+
+	for _, pi := range p.deadlines {
 		piece := p.getPiece(pi)
 
-		if piece.status != PieceInProgress {
-			break
+		if has, _ := have.Get(pi); !has || piece.priority == PrioritySkip {
+			continue
 		}
 
-		if has, _ := have.Get(pi); has {
+		if piece.status == PieceInQueue || piece.status == PieceInProgress {
+			if piece.status == PieceInQueue && !p.reserve(pi) {
+				return 0, 0, ErrMemoryBudget
+			}
+
 			return pi, p.pickNextBlock(piece, pi, peer), nil
 		}
-	}
 
-	return 0, 0, errors.New("No pieces found")
-}
+		if piece.status != PiecePending || !p.isDeadlineAtRisk(piece, pi, now) {
+			continue
+		}
 
-func (p *Picker) pickRandom(have bitfield.Bitfield, peer string) (int, int, error) {
-	shuffled := make([]int, len(p.ordered))
-	shuffled = append(shuffled, p.ordered...)
+		for bi, block := range piece.blocks {
+			if block.status != BlockPending || len(block.peers) >= MaxDeadlineDuplicates || slices.Contains(block.peers, peer) {
+				continue
+			}
 
-	p.rand.Shuffle(len(shuffled), func(i, j int) {
-		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
-	})
+			p.requestBlock(block, peer)
+			return pi, bi, nil
+		}
+	}
 
-	for _, pi := range shuffled {
-		piece := p.getPiece(pi)
+	return 0, 0, errors.New("No piece found")
+}
 
-		if piece.status != PieceInQueue {
+// isDeadlineAtRisk reports whether any pending block of piece is not
+// expected to arrive before deadline at requesting peer's rate.
+func (p *Picker) isDeadlineAtRisk(piece *Piece, pi int, now time.Time) bool {
+	if !now.Before(piece.deadline) {
+		return true
+	}
+
+	for bi, block := range piece.blocks {
+		if block.status != BlockPending {
 			continue
 		}
 
-		if has, _ := have.Get(pi); has {
-			return pi, p.pickNextBlock(piece, pi, peer), nil
+		for peer, requested := range block.requested {
+			rate, ok := p.peerRate(peer)
+			if !ok {
+				return true
+			}
+
+			expected := requested.Add(time.Duration(float64(p.layout.BlockSize(pi, bi)) / rate * float64(time.Second)))
+			if expected.After(piece.deadline) {
+				return true
+			}
 		}
 	}
 
-	return 0, 0, errors.New("No piece found")
+	return false
 }
 
-func (p *Picker) pickRarest(have bitfield.Bitfield, peer string) (int, int, error) {
-	for _, pi := range p.ordered {
-		piece := p.getPiece(pi)
+func (p *Picker) pickWindow(have bitfield.Bitfield, peer string) (int, int, error) {
+	count := p.layout.PieceCount()
 
-		if piece.status != PieceInQueue {
-			continue
-		}
+	for _, w := range p.windows {
+		for pi := w.start; pi <= w.end && pi < count; pi++ {
+			piece := p.getPiece(pi)
+
+			if piece.status != PieceInQueue && piece.status != PieceInProgress || piece.priority == PrioritySkip {
+				continue
+			}
+
+			if has, _ := have.Get(pi); !has {
+				continue
+			}
+
+			if piece.status == PieceInQueue && !p.reserve(pi) {
+				return 0, 0, ErrMemoryBudget
+			}
 
-		if has, _ := have.Get(pi); has {
 			return pi, p.pickNextBlock(piece, pi, peer), nil
 		}
 	}
@@ -273,16 +822,16 @@ func (p *Picker) pickNextBlock(piece *Piece, pi int, peer string) int {
 		}
 
 		block.status = BlockPending
-		block.peers = append(block.peers, peer)
+		p.requestBlock(block, peer)
 
 		if piece.status == PieceInQueue {
 			piece.status = PieceInProgress
 			p.counter++
-			p.update()
-		} else if p.isPiecePending(piece) {
+		}
+		if p.isPiecePending(piece) {
 			piece.status = PiecePending
-			p.removePiece(pi)
 		}
+		p.track(pi, piece)
 
 		return bi
 	}
@@ -290,6 +839,23 @@ func (p *Picker) pickNextBlock(piece *Piece, pi int, peer string) int {
 	return -1
 }
 
+func (p *Picker) requestBlock(block *Block, peer string) {
+	block.peers = append(block.peers, peer)
+
+	if block.requested == nil {
+		block.requested = map[string]time.Time{}
+	}
+	block.requested[peer] = time.Now()
+}
+
+func (p *Picker) reserve(pi int) bool {
+	if p.budget == nil {
+		return true
+	}
+
+	return p.budget.Reserve(p.layout.PieceSize(pi))
+}
+
 func (p *Picker) isPiecePending(piece *Piece) bool {
 	for _, block := range piece.blocks {
 		if block.status == BlockInQueue {
@@ -300,44 +866,61 @@ func (p *Picker) isPiecePending(piece *Piece) bool {
 	return true
 }
 
-func (p *Picker) removePiece(pi int) bool {
-	for i, val := range p.ordered {
-		if pi == val {
-			p.ordered = append(p.ordered[:i], p.ordered[i+1:]...)
-			return true
+// track places piece in order according to its status and priority.
+func (p *Picker) track(pi int, piece *Piece) {
+	loc := locNone
+
+	if piece.priority != PrioritySkip {
+		switch piece.status {
+		case PieceInQueue:
+			loc = locQueued
+		case PieceInProgress:
+			loc = locProgress
 		}
 	}
-	return false
+
+	p.order.set(pi, loc, piece.priority)
 }
 
-func (p *Picker) pickEndgame(have bitfield.Bitfield, peer string) (int, int, error) {
-	for pi, piece := range p.pieces {
-		if piece.status == PiecePending {
-			if has, _ := have.Get(pi); !has {
-				continue
-			}
+// pickPendingBlock chooses pending block of piece to duplicate in endgame.
+// Blocks requested from fewest peers are preferred, each block is requested
+// from at most MaxEndgameDuplicates peers and never duplicated by peer that is
+// slower than one it is already requested from.
+func (p *Picker) pickPendingBlock(piece *Piece, pi int, peer string) (int, error) {
+	best := -1
 
-			bi, err := p.pickPendingBlock(piece, pi, peer)
-			if err != nil {
-				continue
-			}
+	for bi, block := range piece.blocks {
+		if block.status != BlockPending || len(block.peers) >= MaxEndgameDuplicates || slices.Contains(block.peers, peer) {
+			continue
+		}
 
-			piece.blocks[bi].peers = append(piece.blocks[bi].peers, peer)
-			return pi, bi, nil
+		if slices.ContainsFunc(block.peers, func(e string) bool { return !p.isFaster(peer, e) }) {
+			continue
+		}
+
+		if best == -1 || len(block.peers) < len(piece.blocks[best].peers) {
+			best = bi
 		}
 	}
 
-	return 0, 0, errors.New("No piece found")
+	if best == -1 {
+		return 0, errors.New("No blocks found")
+	}
+
+	return best, nil
 }
 
-func (p *Picker) pickPendingBlock(piece *Piece, pi int, peer string) (int, error) {
-	for bi, block := range piece.blocks {
-		if block.status == BlockPending && !slices.Contains(block.peers, peer) {
-			return bi, nil
-		}
+// isFaster reports whether peer is faster than other. Peers without
+// measured rate are treated as slower than any measured peer.
+func (p *Picker) isFaster(peer, other string) bool {
+	rate, ok := p.peerRate(peer)
+	otherRate, otherOk := p.peerRate(other)
+
+	if !otherOk {
+		return true
 	}
 
-	return 0, errors.New("No blocks found")
+	return ok && rate > otherRate
 }
 
 // Returns piece state or creates one if it doesn't exists
@@ -346,7 +929,7 @@ func (p *Picker) getPiece(pi int) *Piece {
 
 	if !exists {
 		blocks := p.newBlocksForPiece(pi)
-		piece = &Piece{status: PieceInQueue, blocks: blocks}
+		piece = &Piece{status: PieceInQueue, blocks: blocks, priority: PriorityNormal, verified: make(chan struct{})}
 		p.pieces[pi] = piece
 	}
 
@@ -354,7 +937,7 @@ func (p *Picker) getPiece(pi int) *Piece {
 }
 
 func (p *Picker) newBlocksForPiece(pi int) []*Block {
-	count := CalcBlockCount(p.length, p.maxPieceLength, pi)
+	count := p.layout.BlockCount(pi)
 	blocks := make([]*Block, count)
 	for i := 0; i < count; i++ {
 		block := &Block{status: BlockInQueue}
@@ -364,26 +947,51 @@ func (p *Picker) newBlocksForPiece(pi int) []*Block {
 	return blocks
 }
 
-func (p *Picker) update() {
-	slices.SortFunc(p.ordered, func(a, b int) int {
-		piece1 := p.getPiece(a)
-		piece2 := p.getPiece(b)
-
-		if piece1.status == PieceInProgress && piece2.status == PieceInQueue {
-			return -1
-		} else if piece2.status == PieceInProgress && piece1.status == PieceInQueue {
-			return 1
-		} else if piece1.status == piece2.status {
-			// Sort based on availability
-			if piece1.availability < piece2.availability {
-				return -1
-			} else if piece2.availability < piece1.availability {
-				return 1
-			} else {
-				return 0
-			}
-		}
+// pickerState exposes picker to strategy while picker is locked.
+type pickerState struct {
+	p *Picker
+}
 
-		return 0
-	})
+func (s pickerState) Count() int {
+	return s.p.layout.PieceCount()
+}
+
+func (s pickerState) Piece(pi int) PieceState {
+	state := PieceState{Status: PieceInQueue, Priority: PriorityNormal, Availability: s.p.order.avail[pi]}
+
+	if piece, ok := s.p.pieces[pi]; ok {
+		state.Status = piece.status
+		state.Priority = piece.priority
+	}
+
+	return state
+}
+
+func (s pickerState) InProgress() []int {
+	return s.p.order.progress
+}
+
+func (s pickerState) RangeQueued(fn func(pi int) bool) {
+	s.p.order.rangeQueued(fn)
+}
+
+func (s pickerState) RangeRandom(fn func(pi int) bool) {
+	s.p.order.rangeRandom(s.p.rand, fn)
+}
+
+func (s pickerState) Remaining() int {
+	return s.p.order.remaining()
+}
+
+func (s pickerState) Started() int {
+	return s.p.counter
+}
+
+func (s pickerState) CanDuplicate(pi int, peer string) bool {
+	_, err := s.p.pickPendingBlock(s.p.getPiece(pi), pi, peer)
+	return err == nil
+}
+
+func (s pickerState) Rand() *rand.Rand {
+	return s.p.rand
 }
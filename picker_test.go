@@ -1,7 +1,9 @@
 package gobt_test
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/edwces/gobt"
 	"github.com/edwces/gobt/bitfield"
@@ -14,15 +16,21 @@ const (
 	TestTorrentLength      = TestTorrentPieceLength * TestTorrentTotalPieces
 )
 
+var TestTorrentLayout = gobt.NewLayout(TestTorrentLength, TestTorrentPieceLength)
+
 func TestPickerPick(t *testing.T) {
+	withoutRarest := bitfield.New(TestTorrentTotalPieces)
 	bitfield := bitfield.New(TestTorrentTotalPieces)
 	peerID := "1"
 	for i := 10; i < TestTorrentTotalPieces; i++ {
 		bitfield.Set(i)
+		if i != 15 {
+			withoutRarest.Set(i)
+		}
 	}
 
 	t.Run("strict order", func(t *testing.T) {
-		p := gobt.NewPicker(TestTorrentLength, TestTorrentPieceLength)
+		p := gobt.NewPicker(TestTorrentLayout)
 		want := 0
 
 		for i := 0; i < 10*TestTorrentPieceBlocks; i++ {
@@ -41,10 +49,10 @@ func TestPickerPick(t *testing.T) {
 	})
 
 	t.Run("random", func(t *testing.T) {
-		p := gobt.NewPicker(TestTorrentLength, TestTorrentPieceLength)
+		p := gobt.NewPicker(TestTorrentLayout)
 		p.SetRandSeed(0)
 
-		want := []int{19, 13, 20, 15, 18}
+		want := []int{24, 18, 21, 15, 19}
 
 		for i := 0; i < 5*TestTorrentPieceBlocks; i++ {
 			pi, _, err := p.Pick(bitfield, peerID)
@@ -60,14 +68,23 @@ func TestPickerPick(t *testing.T) {
 	})
 
 	t.Run("rarest", func(t *testing.T) {
-		p := gobt.NewPicker(TestTorrentLength, TestTorrentPieceLength)
+		p := gobt.NewPicker(TestTorrentLayout)
 		p.SetRandSeed(0)
 
 		p.IncrementPieceAvailability(15)
 
 		want := 15
 
-		for i := 0; i < 14*TestTorrentPieceBlocks; i++ {
+		// Pieces of random phase are started without piece 15
+		for i := 0; i < gobt.RandomPieceEndCounter*TestTorrentPieceBlocks; i++ {
+			_, _, err := p.Pick(withoutRarest, peerID)
+
+			if err != nil {
+				t.Fail()
+			}
+		}
+
+		for i := 0; i < (14-gobt.RandomPieceEndCounter)*TestTorrentPieceBlocks; i++ {
 			_, _, err := p.Pick(bitfield, peerID)
 
 			if err != nil {
@@ -87,4 +104,353 @@ func TestPickerPick(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("memory budget", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		p.SetMemoryBudget(gobt.NewMemoryBudget(TestTorrentPieceLength))
+
+		for i := 0; i < TestTorrentPieceBlocks; i++ {
+			_, _, err := p.Pick(bitfield, peerID)
+
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+		}
+
+		_, _, err := p.Pick(bitfield, peerID)
+		if !errors.Is(err, gobt.ErrMemoryBudget) {
+			t.Fatalf("want %v, got %v", gobt.ErrMemoryBudget, err)
+		}
+	})
+
+	t.Run("skip started piece", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		budget := gobt.NewMemoryBudget(TestTorrentPieceLength)
+		p.SetMemoryBudget(budget)
+
+		discarded := -1
+		p.OnDiscard(func(pi int) { discarded = pi })
+
+		pi, _, err := p.Pick(bitfield, peerID)
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+
+		p.SetPiecePriority(pi, gobt.PrioritySkip)
+
+		if discarded != pi {
+			t.Fatalf("want piece %d discarded, got %d", pi, discarded)
+		}
+
+		if used := budget.Used(); used != 0 {
+			t.Fatalf("want budget released, got %d used", used)
+		}
+
+		next, _, err := p.Pick(bitfield, peerID)
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+
+		if next == pi {
+			t.Fatalf("want other piece than skipped %d", pi)
+		}
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		p.SetSequential(true)
+
+		for i := 0; i < 5*TestTorrentPieceBlocks; i++ {
+			pi, _, err := p.Pick(bitfield, peerID)
+
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			if want := 10 + i/TestTorrentPieceBlocks; pi != want {
+				t.Fatalf("want %d, got %d", want, pi)
+			}
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		p.SetPieceDeadline(22, time.Minute)
+		p.SetPieceDeadline(17, time.Second)
+
+		want := []int{17, 22}
+
+		for i := 0; i < 2*TestTorrentPieceBlocks; i++ {
+			pi, _, err := p.Pick(bitfield, peerID)
+
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			if pi != want[i/TestTorrentPieceBlocks] {
+				t.Fatalf("want %d, got %d", want[i/TestTorrentPieceBlocks], pi)
+			}
+		}
+	})
+
+	t.Run("deadline duplicates", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		p.SetPieceDeadline(17, 0)
+
+		for i := 0; i < TestTorrentPieceBlocks; i++ {
+			p.Pick(bitfield, peerID)
+		}
+
+		for i := 0; i < TestTorrentPieceBlocks; i++ {
+			pi, bi, err := p.Pick(bitfield, "2")
+
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			if pi != 17 || bi != i {
+				t.Fatalf("want %d:%d, got %d:%d", 17, i, pi, bi)
+			}
+		}
+	})
+
+	t.Run("deadline peer rates", func(t *testing.T) {
+		tests := map[string]struct {
+			rates     fakeRates
+			duplicate bool
+		}{
+			"slower than average": {rates: fakeRates{peerID: 1000, "2": 10}, duplicate: false},
+			// Rates of disconnected peers are not averaged
+			"fast peer left": {rates: fakeRates{"2": 10}, duplicate: true},
+		}
+
+		for name, test := range tests {
+			t.Run(name, func(t *testing.T) {
+				p := gobt.NewPicker(TestTorrentLayout)
+				p.SetPeerRates(test.rates)
+				p.SetPieceDeadline(17, 0)
+
+				for i := 0; i < TestTorrentPieceBlocks; i++ {
+					p.Pick(bitfield, peerID)
+				}
+
+				pi, _, err := p.Pick(bitfield, "2")
+				if err != nil {
+					t.Fatalf("want nil, got err: %s", err.Error())
+				}
+
+				if got := pi == 17; got != test.duplicate {
+					t.Fatalf("want duplicate of deadline piece %t, got piece %d", test.duplicate, pi)
+				}
+			})
+		}
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		p.SetSequential(true)
+
+		for i := 10; i < 20; i++ {
+			p.SetPiecePriority(i, gobt.PrioritySkip)
+		}
+
+		for i := 0; i < 5*TestTorrentPieceBlocks; i++ {
+			pi, _, err := p.Pick(bitfield, peerID)
+
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			if want := 20 + i/TestTorrentPieceBlocks; pi != want {
+				t.Fatalf("want %d, got %d", want, pi)
+			}
+		}
+
+		if done, wanted := p.WantedProgress(); done != 0 || wanted != TestTorrentTotalPieces-10 {
+			t.Fatalf("want %d/%d, got %d/%d", 0, TestTorrentTotalPieces-10, done, wanted)
+		}
+	})
+
+	t.Run("file priority", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		p.SetFiles([]gobt.FileEntry{
+			{Path: "a", Offset: 0, Length: 15*TestTorrentPieceLength + 10},
+			{Path: "b", Offset: 15*TestTorrentPieceLength + 10, Length: 10*TestTorrentPieceLength - 10},
+		})
+		p.SetFilePriority(1, gobt.PrioritySkip)
+		p.SetSequential(true)
+
+		for i := 0; i < 6*TestTorrentPieceBlocks; i++ {
+			pi, _, err := p.Pick(bitfield, peerID)
+
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			if want := 10 + i/TestTorrentPieceBlocks; pi != want {
+				t.Fatalf("want %d, got %d", want, pi)
+			}
+		}
+
+		_, _, err := p.Pick(bitfield, peerID)
+		if err == nil {
+			t.Fatalf("want err, got nil")
+		}
+	})
+
+	t.Run("endgame", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		for i := 0; i < TestTorrentTotalPieces; i++ {
+			if i != 10 {
+				p.SetPiecePriority(i, gobt.PrioritySkip)
+			}
+		}
+
+		for _, peer := range []string{"1", "2"} {
+			for i := 0; i < TestTorrentPieceBlocks; i++ {
+				_, bi, err := p.Pick(bitfield, peer)
+
+				if err != nil {
+					t.Fatalf("want nil, got err: %s", err.Error())
+				}
+
+				if bi != i {
+					t.Fatalf("want %d, got %d", i, bi)
+				}
+			}
+		}
+
+		_, _, err := p.Pick(bitfield, "3")
+		if err == nil {
+			t.Fatalf("want err, got nil")
+		}
+
+		cancel := p.MarkBlockDone(10, 0, "2")
+		if len(cancel) != 1 || cancel[0] != "1" {
+			t.Fatalf("want [1], got %v", cancel)
+		}
+
+		p.FailPendingBlock(10, 1, "2")
+		_, bi, err := p.Pick(bitfield, "3")
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+
+		if bi != 1 {
+			t.Fatalf("want 1, got %d", bi)
+		}
+	})
+
+	t.Run("custom strategy", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		p.SetStrategy(lastPieceStrategy{})
+
+		for i := 0; i < 3*TestTorrentPieceBlocks; i++ {
+			pi, _, err := p.Pick(bitfield, peerID)
+
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			if want := TestTorrentTotalPieces - 1 - i/TestTorrentPieceBlocks; pi != want {
+				t.Fatalf("want %d, got %d", want, pi)
+			}
+		}
+	})
+
+	t.Run("invalid strategy piece", func(t *testing.T) {
+		for name, pi := range map[string]int{
+			"negative":      -1,
+			"out of range":  TestTorrentTotalPieces,
+			"not available": 1,
+		} {
+			p := gobt.NewPicker(TestTorrentLayout)
+			p.SetStrategy(fixedStrategy(pi))
+
+			if _, _, err := p.Pick(bitfield, peerID); err == nil {
+				t.Fatalf("%s: want err, got nil", name)
+			}
+		}
+	})
+}
+
+// fakeRates reports fixed rates of connected peers.
+type fakeRates map[string]float64
+
+func (r fakeRates) PeerRate(peer string) (float64, bool) {
+	rate, ok := r[peer]
+	return rate, ok
+}
+
+func (r fakeRates) PeerRates() []float64 {
+	rates := []float64{}
+	for _, rate := range r {
+		rates = append(rates, rate)
+	}
+
+	return rates
+}
+
+// lastPieceStrategy chooses the highest available piece with queued blocks.
+type lastPieceStrategy struct{}
+
+func (lastPieceStrategy) Choose(have bitfield.Bitfield, peer string, state gobt.PickState) (int, error) {
+	for pi := state.Count() - 1; pi >= 0; pi-- {
+		status := state.Piece(pi).Status
+
+		if has, _ := have.Get(pi); has && (status == gobt.PieceInQueue || status == gobt.PieceInProgress) {
+			return pi, nil
+		}
+	}
+
+	return 0, errors.New("No piece found")
+}
+
+// fixedStrategy always chooses the same piece.
+type fixedStrategy int
+
+func (s fixedStrategy) Choose(have bitfield.Bitfield, peer string, state gobt.PickState) (int, error) {
+	return int(s), nil
+}
+
+const BenchTorrentTotalPieces = 100000
+
+func BenchmarkPickerIncrementPieceAvailability(b *testing.B) {
+	p := gobt.NewPicker(gobt.NewLayout(TestTorrentPieceLength*BenchTorrentTotalPieces, TestTorrentPieceLength))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.IncrementPieceAvailability(i % BenchTorrentTotalPieces)
+	}
+}
+
+func BenchmarkPickerIncrementAvailability(b *testing.B) {
+	p := gobt.NewPicker(gobt.NewLayout(TestTorrentPieceLength*BenchTorrentTotalPieces, TestTorrentPieceLength))
+	have := bitfield.New(BenchTorrentTotalPieces)
+	for i := 0; i < BenchTorrentTotalPieces; i += 2 {
+		have.Set(i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.IncrementAvailability(have)
+	}
+}
+
+func BenchmarkPickerPick(b *testing.B) {
+	p := gobt.NewPicker(gobt.NewLayout(TestTorrentPieceLength*BenchTorrentTotalPieces, TestTorrentPieceLength))
+	have := bitfield.New(BenchTorrentTotalPieces)
+	for i := 0; i < BenchTorrentTotalPieces; i++ {
+		have.Set(i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pi, _, err := p.Pick(have, "1")
+		if err != nil {
+			b.Fatalf("want nil, got err: %s", err.Error())
+		}
+
+		p.IncrementPieceAvailability(pi)
+	}
 }
@@ -0,0 +1,67 @@
+package gobt
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Queue depth used until peer rate and round trip time are measured
+	InitialRequestDepth = 5
+	MinRequestDepth     = 2
+	// Default limit of outstanding requests if peer does not send reqq
+	MaxRequestDepth = 250
+	// Requests kept above bandwidth-delay product so peer never idles
+	RequestDepthHeadroom = 2
+)
+
+// pipeline sizes queue of outstanding requests to bandwidth-delay product of
+// peer link. Round trip time is the fastest observed request latency, as
+// latency of queued requests also includes time spent behind other blocks.
+type pipeline struct {
+	depth     int
+	remoteMax int
+	rtt       time.Duration
+}
+
+func newPipeline() pipeline {
+	return pipeline{depth: InitialRequestDepth, remoteMax: MaxRequestDepth}
+}
+
+// received records block of length that was requested at sent, and resizes
+// queue to download rate of peer once it is measured.
+func (pl *pipeline) received(length int, sent, now time.Time, rate float64) {
+	if latency := now.Sub(sent); latency > 0 && (pl.rtt == 0 || latency < pl.rtt) {
+		pl.rtt = latency
+	}
+
+	if rate > 0 {
+		pl.resize(rate, length)
+	}
+}
+
+func (pl *pipeline) resize(rate float64, blockLength int) {
+	bdp := rate * pl.rtt.Seconds() / float64(blockLength)
+	depth := int(math.Ceil(bdp)) + RequestDepthHeadroom
+
+	if depth < MinRequestDepth {
+		depth = MinRequestDepth
+	}
+	if depth > pl.remoteMax {
+		depth = pl.remoteMax
+	}
+
+	pl.depth = depth
+}
+
+// setRemoteMax limits depth to number of requests peer is willing to queue.
+func (pl *pipeline) setRemoteMax(reqq int) {
+	if reqq <= 0 {
+		reqq = MaxRequestDepth
+	}
+
+	pl.remoteMax = reqq
+	if pl.depth > reqq {
+		pl.depth = reqq
+	}
+}
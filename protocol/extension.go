@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Extended message ID of extension handshake
+const ExtHandshakeID = 0
+
+// ErrNotExtHandshake is returned when extended message is not handshake.
+var ErrNotExtHandshake = errors.New("not extension handshake")
+
+// ExtHandshake is extension handshake of BEP 10. Only fields gobt uses are
+// decoded, others are ignored.
+type ExtHandshake struct {
+	// M maps names of supported extensions to their message IDs
+	M map[string]int `bencode:"m"`
+	// V is client name and version
+	V string `bencode:"v,omitempty"`
+	// Reqq is number of outstanding requests peer keeps without dropping
+	Reqq int `bencode:"reqq,omitempty"`
+}
+
+// Marshal returns payload of extended message carrying handshake.
+func (h *ExtHandshake) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteByte(ExtHandshakeID)
+	err := bencode.Marshal(&buf, *h)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalExtHandshake decodes payload of extended message. It returns
+// ErrNotExtHandshake for other extended messages.
+func UnmarshalExtHandshake(payload []byte) (*ExtHandshake, error) {
+	if len(payload) == 0 || payload[0] != ExtHandshakeID {
+		return nil, ErrNotExtHandshake
+	}
+
+	h := &ExtHandshake{}
+	err := bencode.Unmarshal(bytes.NewReader(payload[1:]), h)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
@@ -0,0 +1,56 @@
+package protocol_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/edwces/gobt/protocol"
+)
+
+func TestUnmarshalExtHandshake(t *testing.T) {
+	tests := map[string]struct {
+		input []byte
+		want  *protocol.ExtHandshake
+		err   error
+	}{
+		"handshake": {
+			input: append([]byte{protocol.ExtHandshakeID}, "d1:md11:ut_metadatai3ee4:reqqi250e1:v13:qBittorrent 46:yourip4:\x7f\x00\x00\x01e"...),
+			want:  &protocol.ExtHandshake{M: map[string]int{"ut_metadata": 3}, V: "qBittorrent 4", Reqq: 250},
+		},
+		"other extended message": {input: []byte{3, 'd', 'e'}, err: protocol.ErrNotExtHandshake},
+		"empty":                  {input: []byte{}, err: protocol.ErrNotExtHandshake},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := protocol.UnmarshalExtHandshake(test.input)
+
+			if !errors.Is(err, test.err) {
+				t.Fatalf("want %v, got %v", test.err, err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("want %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestMarshalExtHandshake(t *testing.T) {
+	hs := &protocol.ExtHandshake{M: map[string]int{}, Reqq: 2}
+
+	payload, err := hs.Marshal()
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	got, err := protocol.UnmarshalExtHandshake(payload)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(got, hs) {
+		t.Fatalf("want %+v, got %+v", hs, got)
+	}
+}
@@ -9,6 +9,10 @@ import (
 const (
 	HandshakeDefaultPstr = "BitTorrent protocol"
 	HandshakeConstSize   = 49
+
+	// Reserved bit that advertises extension protocol (BEP 10)
+	extensionByte = 5
+	extensionBit  = 0x10
 )
 
 type Handshake struct {
@@ -27,6 +31,16 @@ func NewHandshake(infoHash [20]byte, peerID [20]byte) *Handshake {
 	}
 }
 
+// SetExtensions advertises support of extension protocol.
+func (hs *Handshake) SetExtensions() {
+	hs.Reserved[extensionByte] |= extensionBit
+}
+
+// SupportsExtensions reports if peer supports extension protocol.
+func (hs *Handshake) SupportsExtensions() bool {
+	return hs.Reserved[extensionByte]&extensionBit != 0
+}
+
 func (hs *Handshake) PstrLen() uint8 {
 	return uint8(len(hs.Pstr))
 }
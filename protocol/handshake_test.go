@@ -81,3 +81,21 @@ func TestUnmarshalHandshake(t *testing.T) {
 		})
 	}
 }
+
+func TestHandshakeExtensions(t *testing.T) {
+	hs := protocol.NewHandshake([20]byte{}, [20]byte{})
+	if hs.SupportsExtensions() {
+		t.Fatalf("want no extensions by default")
+	}
+
+	hs.SetExtensions()
+
+	got, err := protocol.UnmarshalHandshake(bytes.NewReader(hs.Marshal()))
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if !got.SupportsExtensions() || got.Reserved[5] != 0x10 {
+		t.Fatalf("want extension bit set, got reserved %v", got.Reserved)
+	}
+}
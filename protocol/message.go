@@ -19,6 +19,9 @@ const (
 	IDPiece
 	IDCancel
 	IDPort
+
+	// Message of extension protocol (BEP 10)
+	IDExtended MessageID = 20
 )
 
 var stringMap = map[MessageID]string{
@@ -32,6 +35,7 @@ var stringMap = map[MessageID]string{
 	IDPiece:         "PIECE",
 	IDCancel:        "CANCEL",
 	IDPort:          "PORT",
+	IDExtended:      "EXTENDED",
 }
 
 type Message struct {
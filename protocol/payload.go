@@ -3,14 +3,28 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"math"
 )
 
+// ErrOutOfRange is returned when value does not fit in 32-bit message field.
+var ErrOutOfRange = errors.New("value out of 32-bit range")
+
 type Request struct {
 	Index  uint32
 	Offset uint32
 	Length uint32
 }
 
+// NewRequest creates request, checking that every field fits in uint32.
+func NewRequest(index, offset, length int64) (*Request, error) {
+	if !fitsUint32(index) || !fitsUint32(offset) || !fitsUint32(length) {
+		return nil, ErrOutOfRange
+	}
+
+	return &Request{Index: uint32(index), Offset: uint32(offset), Length: uint32(length)}, nil
+}
+
 func (r *Request) Marshal() []byte {
 	var buf bytes.Buffer
 
@@ -39,6 +53,15 @@ func (b *Block) Marshal() []byte {
 
 type Have uint32
 
+// NewHave creates have message payload, checking that index fits in uint32.
+func NewHave(index int64) (Have, error) {
+	if !fitsUint32(index) {
+		return 0, ErrOutOfRange
+	}
+
+	return Have(index), nil
+}
+
 func (h Have) Marshal() []byte {
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, h)
@@ -67,3 +90,7 @@ func (p Payload) Block() Block {
 func (p Payload) Have() uint32 {
 	return binary.BigEndian.Uint32(p[0:4])
 }
+
+func fitsUint32(v int64) bool {
+	return v >= 0 && v <= math.MaxUint32
+}
@@ -2,6 +2,7 @@ package protocol_test
 
 import (
 	"bytes"
+	"errors"
 	"reflect"
 	"testing"
 
@@ -81,3 +82,20 @@ func TestPayloadHave(t *testing.T) {
 		t.Fatalf("got %d, want %d", got, want)
 	}
 }
+
+func TestNewRequest(t *testing.T) {
+	_, err := protocol.NewRequest(1<<32, 0, 16384)
+	if !errors.Is(err, protocol.ErrOutOfRange) {
+		t.Fatalf("got %v, want %v", err, protocol.ErrOutOfRange)
+	}
+
+	got, err := protocol.NewRequest(1<<32-1, 0, 16384)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+
+	want := &protocol.Request{Index: 1<<32 - 1, Offset: 0, Length: 16384}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
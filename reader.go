@@ -0,0 +1,230 @@
+package gobt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReadahead = 5
+
+	// Deadline of piece that a read is blocked on
+	ReadDeadline = 2 * time.Second
+)
+
+// ErrReaderClosed is returned by reads of reader that was closed, including
+// reads that were blocked.
+var ErrReaderClosed = errors.New("reader closed")
+
+// Reader reads torrent content while it is being downloaded. Reads block
+// until pieces under the read position are verified, and pieces from the
+// read position up to readahead are picked before any other piece.
+type Reader struct {
+	ctx    context.Context
+	data   io.ReaderAt
+	picker *Picker
+
+	layout    Layout
+	offset    int64
+	readahead int
+	// window is ID of picker window, or 0 until first read or seek
+	window int
+	// deadlines are pieces that blocked reads set deadline of
+	deadlines map[int]struct{}
+	closed    chan struct{}
+
+	sync.Mutex
+}
+
+// NewReader creates reader over data which holds verified pieces of torrent
+// with given layout.
+func NewReader(data io.ReaderAt, picker *Picker, layout Layout) *Reader {
+	return &Reader{
+		ctx:       context.Background(),
+		data:      data,
+		picker:    picker,
+		layout:    layout,
+		readahead: DefaultReadahead,
+		deadlines: map[int]struct{}{},
+		closed:    make(chan struct{}),
+	}
+}
+
+// SetContext sets context that cancels blocked reads.
+func (r *Reader) SetContext(ctx context.Context) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.ctx = ctx
+}
+
+// SetReadahead sets how many pieces after the read position are prioritised.
+func (r *Reader) SetReadahead(pieces int) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.readahead = pieces
+	if r.window != 0 {
+		r.prioritize(r.offset)
+	}
+}
+
+func (r *Reader) Read(b []byte) (int, error) {
+	r.Lock()
+	off := r.offset
+	r.Unlock()
+
+	n, err := r.readAt(b, off)
+
+	r.Lock()
+	r.offset += int64(n)
+	r.Unlock()
+
+	return n, err
+}
+
+func (r *Reader) ReadAt(b []byte, off int64) (int, error) {
+	read := 0
+	for read < len(b) {
+		n, err := r.readAt(b[read:], off+int64(read))
+		read += n
+
+		if err != nil {
+			return read, err
+		}
+	}
+
+	return read, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.layout.Length + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.offset = abs
+	if abs < r.layout.Length {
+		r.prioritize(abs)
+	}
+
+	return abs, nil
+}
+
+// Close releases reader priorities and deadlines in picker, and unblocks
+// pending reads.
+func (r *Reader) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+	close(r.closed)
+
+	if r.window != 0 {
+		r.picker.RemoveWindow(r.window)
+		r.window = 0
+	}
+
+	for pi := range r.deadlines {
+		r.picker.ClearPieceDeadline(pi)
+	}
+	r.deadlines = map[int]struct{}{}
+
+	return nil
+}
+
+// readAt reads at most up to the end of piece containing off. Reader lock
+// is not held while waiting for piece, so reader can be closed meanwhile.
+func (r *Reader) readAt(b []byte, off int64) (int, error) {
+	if off >= r.layout.Length {
+		return 0, io.EOF
+	}
+
+	pi := r.layout.PieceAt(off)
+
+	r.Lock()
+	select {
+	case <-r.closed:
+		r.Unlock()
+		return 0, ErrReaderClosed
+	default:
+	}
+
+	r.prioritize(off)
+
+	verified := r.picker.PieceVerified(pi)
+	select {
+	case <-verified:
+	default:
+		r.picker.SetPieceDeadline(pi, ReadDeadline)
+		r.deadlines[pi] = struct{}{}
+	}
+	ctx := r.ctx
+	r.Unlock()
+
+	select {
+	case <-verified:
+		// Picker clears deadline of verified piece
+		r.Lock()
+		delete(r.deadlines, pi)
+		r.Unlock()
+	case <-ctx.Done():
+		r.clearDeadline(pi)
+		return 0, ctx.Err()
+	case <-r.closed:
+		return 0, ErrReaderClosed
+	}
+
+	end := r.layout.PieceOffset(pi) + int64(r.layout.PieceSize(pi))
+	if int64(len(b)) > end-off {
+		b = b[:end-off]
+	}
+
+	return r.data.ReadAt(b, off)
+}
+
+// clearDeadline removes deadline of piece that read is no longer blocked on.
+func (r *Reader) clearDeadline(pi int) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.deadlines[pi]; ok {
+		r.picker.ClearPieceDeadline(pi)
+		delete(r.deadlines, pi)
+	}
+}
+
+// prioritize moves window to piece at off. Window is added on first read or
+// seek, so reader that starts in the middle of torrent does not prioritise
+// its first pieces.
+func (r *Reader) prioritize(off int64) {
+	pi := r.layout.PieceAt(off)
+	if r.window == 0 {
+		r.window = r.picker.AddWindow(pi, pi+r.readahead)
+		return
+	}
+
+	r.picker.SetWindow(r.window, pi, pi+r.readahead)
+}
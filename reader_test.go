@@ -0,0 +1,116 @@
+package gobt_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/edwces/gobt"
+	"github.com/edwces/gobt/bitfield"
+)
+
+func TestReader(t *testing.T) {
+	data := make([]byte, TestTorrentLength)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	t.Run("waits for pieces", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		r := gobt.NewReader(bytes.NewReader(data), p, TestTorrentLayout)
+		defer r.Close()
+
+		go func() {
+			for i := 0; i < TestTorrentTotalPieces; i++ {
+				p.MarkPieceVerified(i)
+			}
+		}()
+
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Fatalf("read data does not match")
+		}
+	})
+
+	t.Run("prioritises read position", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		r := gobt.NewReader(bytes.NewReader(data), p, TestTorrentLayout)
+		defer r.Close()
+
+		r.Seek(20*TestTorrentPieceLength, io.SeekStart)
+
+		pi, _, err := p.Pick(bitfield.New(TestTorrentTotalPieces), "1")
+		if err == nil {
+			t.Fatalf("want err, got piece %d", pi)
+		}
+
+		bf := bitfield.New(TestTorrentTotalPieces)
+		for i := 0; i < TestTorrentTotalPieces; i++ {
+			bf.Set(i)
+		}
+
+		pi, _, err = p.Pick(bf, "1")
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+
+		if pi != 20 {
+			t.Fatalf("want %d, got %d", 20, pi)
+		}
+	})
+
+	t.Run("close unblocks read", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		p.SetStrategy(fixedStrategy(5))
+		r := gobt.NewReader(bytes.NewReader(data), p, TestTorrentLayout)
+
+		r.Seek(20*TestTorrentPieceLength, io.SeekStart)
+
+		errc := make(chan error)
+		go func() {
+			_, err := r.Read(make([]byte, 10))
+			errc <- err
+		}()
+
+		r.Close()
+		if err := <-errc; !errors.Is(err, gobt.ErrReaderClosed) {
+			t.Fatalf("want %v, got %v", gobt.ErrReaderClosed, err)
+		}
+
+		// Neither window nor deadline of reader is left in picker
+		bf := bitfield.New(TestTorrentTotalPieces)
+		for i := 0; i < TestTorrentTotalPieces; i++ {
+			bf.Set(i)
+		}
+
+		pi, _, err := p.Pick(bf, "1")
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+
+		if pi != 5 {
+			t.Fatalf("want %d, got %d", 5, pi)
+		}
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		p := gobt.NewPicker(TestTorrentLayout)
+		r := gobt.NewReader(bytes.NewReader(data), p, TestTorrentLayout)
+		defer r.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r.SetContext(ctx)
+
+		_, err := r.Read(make([]byte, 10))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("want %v, got %v", context.Canceled, err)
+		}
+	})
+}
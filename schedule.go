@@ -0,0 +1,302 @@
+package gobt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often scheduler checks whether another rule applies
+const ScheduleCheckPeriod = time.Minute
+
+// ScheduleRule sets bandwidth limits on given days between start and end
+// time of day. Rule that ends before it starts runs past midnight into the
+// next day.
+type ScheduleRule struct {
+	Days  [7]bool
+	Start time.Duration
+	End   time.Duration
+
+	Download int
+	Upload   int
+}
+
+func (r ScheduleRule) matches(t time.Time) bool {
+	day := t.Weekday()
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	if r.Start <= r.End {
+		return r.Days[day] && since >= r.Start && since < r.End
+	}
+
+	// Overnight rule belongs to the day it started
+	yesterday := (day + 6) % 7
+	return r.Days[day] && since >= r.Start || r.Days[yesterday] && since < r.End
+}
+
+// Schedule is list of rules, the first rule matching current time sets the
+// limits, otherwise default limits apply.
+type Schedule struct {
+	Rules []ScheduleRule
+
+	Download int
+	Upload   int
+}
+
+// LimitsAt returns download and upload limit at time t.
+func (s *Schedule) LimitsAt(t time.Time) (int, int) {
+	for _, rule := range s.Rules {
+		if rule.matches(t) {
+			return rule.Download, rule.Upload
+		}
+	}
+
+	return s.Download, s.Upload
+}
+
+// ParseSchedule reads schedule with one rule per line:
+//
+//	# days     time         download upload
+//	weekdays   09:00-18:00  1MB      200KB
+//	sat,sun    22:00-06:00  unlimited 50KB
+//	default                 0        0
+//
+// Days are daily, weekdays, weekends, or comma separated list of day names
+// and ranges like mon-fri. Rates are bytes per second with optional K, M or
+// G suffix, or unlimited.
+func ParseSchedule(r io.Reader) (*Schedule, error) {
+	return ParseScheduleDefault(r, 0, 0)
+}
+
+// ParseScheduleDefault reads schedule like ParseSchedule, with default
+// limits of download and upload unless schedule has default line.
+func ParseScheduleDefault(r io.Reader, download, upload int) (*Schedule, error) {
+	s := &Schedule{Download: download, Upload: upload}
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i != -1 {
+			text = text[:i]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var err error
+		if fields[0] == "default" {
+			err = parseScheduleDefault(s, fields)
+		} else {
+			var rule ScheduleRule
+			rule, err = parseScheduleRule(fields)
+			s.Rules = append(s.Rules, rule)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("schedule line %d: %w", line, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func parseScheduleDefault(s *Schedule, fields []string) error {
+	if len(fields) != 3 {
+		return fmt.Errorf("want default download upload, got %q", strings.Join(fields, " "))
+	}
+
+	var err error
+	s.Download, err = parseRate(fields[1])
+	if err != nil {
+		return err
+	}
+
+	s.Upload, err = parseRate(fields[2])
+	return err
+}
+
+func parseScheduleRule(fields []string) (ScheduleRule, error) {
+	rule := ScheduleRule{}
+
+	if len(fields) != 4 {
+		return rule, fmt.Errorf("want days time download upload, got %q", strings.Join(fields, " "))
+	}
+
+	var err error
+	rule.Days, err = parseDays(fields[0])
+	if err != nil {
+		return rule, err
+	}
+
+	start, end, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return rule, fmt.Errorf("invalid time range: %s", fields[1])
+	}
+
+	rule.Start, err = parseTimeOfDay(start)
+	if err != nil {
+		return rule, err
+	}
+
+	rule.End, err = parseTimeOfDay(end)
+	if err != nil {
+		return rule, err
+	}
+
+	rule.Download, err = parseRate(fields[2])
+	if err != nil {
+		return rule, err
+	}
+
+	rule.Upload, err = parseRate(fields[3])
+	return rule, err
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseDays(text string) ([7]bool, error) {
+	var days [7]bool
+
+	switch text {
+	case "daily":
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	case "weekdays":
+		return [7]bool{false, true, true, true, true, true, false}, nil
+	case "weekends":
+		return [7]bool{true, false, false, false, false, false, true}, nil
+	}
+
+	for _, part := range strings.Split(text, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+
+		first, ok := dayNames[from]
+		if !ok {
+			return days, fmt.Errorf("invalid day: %s", from)
+		}
+
+		last, ok := dayNames[to]
+		if !ok {
+			return days, fmt.Errorf("invalid day: %s", to)
+		}
+
+		// Ranges may wrap around the week, like fri-mon
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+func parseTimeOfDay(text string) (time.Duration, error) {
+	if text == "24:00" {
+		return 24 * time.Hour, nil
+	}
+
+	t, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", text)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseRate(text string) (int, error) {
+	if text == "unlimited" {
+		return 0, nil
+	}
+
+	unit := 1
+	upper := strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(text, "/s"), "B"))
+
+	switch {
+	case strings.HasSuffix(upper, "K"):
+		unit = 1000
+	case strings.HasSuffix(upper, "M"):
+		unit = 1000 * 1000
+	case strings.HasSuffix(upper, "G"):
+		unit = 1000 * 1000 * 1000
+	}
+	if unit != 1 {
+		upper = upper[:len(upper)-1]
+	}
+
+	n, err := strconv.ParseFloat(upper, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate: %s", text)
+	}
+
+	return int(n * float64(unit)), nil
+}
+
+// Scheduler switches bandwidth limit according to schedule.
+type Scheduler struct {
+	limit    *BandwidthLimit
+	schedule *Schedule
+
+	sync.Mutex
+}
+
+func NewScheduler(limit *BandwidthLimit, schedule *Schedule) *Scheduler {
+	return &Scheduler{limit: limit, schedule: schedule}
+}
+
+// SetSchedule replaces schedule and applies it immediately.
+func (s *Scheduler) SetSchedule(schedule *Schedule) {
+	s.Lock()
+	s.schedule = schedule
+	s.Unlock()
+
+	s.Apply(time.Now())
+}
+
+func (s *Scheduler) Schedule() *Schedule {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.schedule
+}
+
+// Apply sets limits of schedule at time t.
+func (s *Scheduler) Apply(t time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.limit.SetLimit(s.schedule.LimitsAt(t))
+}
+
+// Run applies schedule every ScheduleCheckPeriod until stop is closed.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(ScheduleCheckPeriod)
+	defer ticker.Stop()
+
+	s.Apply(time.Now())
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.Apply(now)
+		}
+	}
+}
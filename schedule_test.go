@@ -0,0 +1,102 @@
+package gobt_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edwces/gobt"
+)
+
+const TestSchedule = `
+# Throttle during working hours
+weekdays  09:00-18:00  1MB        200KB
+sat,sun   22:00-06:00  unlimited  50KB
+default                0          0
+`
+
+func TestScheduleLimitsAt(t *testing.T) {
+	s, err := gobt.ParseSchedule(strings.NewReader(TestSchedule))
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	tests := map[string]struct {
+		at       time.Time
+		download int
+		upload   int
+	}{
+		"working hours":     {at: time.Date(2024, 1, 3, 12, 0, 0, 0, time.Local), download: 1000000, upload: 200000},
+		"after work":        {at: time.Date(2024, 1, 3, 18, 0, 0, 0, time.Local), download: 0, upload: 0},
+		"weekend afternoon": {at: time.Date(2024, 1, 6, 12, 0, 0, 0, time.Local), download: 0, upload: 0},
+		"saturday night":    {at: time.Date(2024, 1, 6, 23, 0, 0, 0, time.Local), download: 0, upload: 50000},
+		"monday morning":    {at: time.Date(2024, 1, 8, 5, 0, 0, 0, time.Local), download: 0, upload: 50000},
+		"friday morning":    {at: time.Date(2024, 1, 5, 5, 0, 0, 0, time.Local), download: 0, upload: 0},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			download, upload := s.LimitsAt(test.at)
+
+			if download != test.download || upload != test.upload {
+				t.Fatalf("want %d/%d, got %d/%d", test.download, test.upload, download, upload)
+			}
+		})
+	}
+}
+
+func TestParseScheduleDefault(t *testing.T) {
+	tests := map[string]struct {
+		text     string
+		download int
+		upload   int
+	}{
+		"no default line":   {text: "daily 09:00-10:00 1MB 1MB", download: 500, upload: 100},
+		"default line wins": {text: "daily 09:00-10:00 1MB 1MB\ndefault 2KB 1KB", download: 2000, upload: 1000},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := gobt.ParseScheduleDefault(strings.NewReader(test.text), 500, 100)
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			download, upload := s.LimitsAt(time.Date(2024, 1, 3, 12, 0, 0, 0, time.Local))
+			if download != test.download || upload != test.upload {
+				t.Fatalf("want %d/%d, got %d/%d", test.download, test.upload, download, upload)
+			}
+		})
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown day":  "someday 09:00-18:00 1MB 1MB",
+		"invalid time": "daily 9-18 1MB 1MB",
+		"invalid rate": "daily 09:00-18:00 fast 1MB",
+		"missing rate": "default 1MB",
+	}
+
+	for name, text := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := gobt.ParseSchedule(strings.NewReader(text)); err == nil {
+				t.Fatalf("want err, got nil")
+			}
+		})
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s, err := gobt.ParseSchedule(strings.NewReader("daily 00:00-24:00 1MB 200KB"))
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	limit := gobt.NewBandwidthLimit(0, 0)
+	gobt.NewScheduler(limit, &gobt.Schedule{}).SetSchedule(s)
+
+	if limit.Download.Limit() != 1000000 || limit.Upload.Limit() != 200000 {
+		t.Fatalf("want 1000000/200000, got %d/%d", limit.Download.Limit(), limit.Upload.Limit())
+	}
+}
@@ -2,7 +2,8 @@ package gobt
 
 import (
 	"crypto/sha1"
-	"math"
+	"hash"
+	"sync"
 )
 
 // NEEDS:
@@ -11,41 +12,174 @@ import (
 // - easy way to determine if full / fast access
 // - way to verify
 
-func PieceSize(tSize, pMaxSize, pIndex int) int {
-	return int(math.Min(float64(pMaxSize), float64(tSize)-float64(pMaxSize)*float64(pIndex)))
+// pieceHasher keeps streaming SHA-1 state for a piece. Blocks are consumed
+// in order as they are saved, blocks that arrive ahead of the hashed offset
+// are held until the gap before them is filled.
+type pieceHasher struct {
+	hash   hash.Hash
+	offset int
+	queued map[int][]byte
+}
+
+func newPieceHasher() *pieceHasher {
+	return &pieceHasher{hash: sha1.New(), queued: map[int][]byte{}}
+}
+
+// has reports if block at offset was already hashed or is queued.
+func (ph *pieceHasher) has(offset int) bool {
+	_, queued := ph.queued[offset]
+	return offset < ph.offset || queued
+}
+
+func (ph *pieceHasher) write(block []byte, offset int) {
+	if offset != ph.offset {
+		if offset > ph.offset {
+			ph.queued[offset] = block
+		}
+		return
+	}
+
+	ph.hash.Write(block)
+	ph.offset += len(block)
+
+	for {
+		next, ok := ph.queued[ph.offset]
+		if !ok {
+			break
+		}
+
+		delete(ph.queued, ph.offset)
+		ph.hash.Write(next)
+		ph.offset += len(next)
+	}
 }
 
 type Storage struct {
-	bufs [][]byte
+	bufs    [][]byte
+	hashers []*pieceHasher
+	// verified pieces no longer accept blocks
+	verified []bool
 
-	tSize    int
-	pMaxSize int
+	layout Layout
+	budget *MemoryBudget
+
+	sync.Mutex
+}
+
+func NewStorage(layout Layout) *Storage {
+	size := layout.PieceCount()
+	return &Storage{bufs: make([][]byte, size), hashers: make([]*pieceHasher, size), verified: make([]bool, size), layout: layout}
 }
 
-func NewStorage(tSize, pMaxSize int) *Storage {
-	size := CalcPieceCount(tSize, pMaxSize)
-	return &Storage{bufs: make([][]byte, size), tSize: tSize, pMaxSize: pMaxSize}
+// SetMemoryBudget sets budget which is released when piece buffers are freed.
+func (s *Storage) SetMemoryBudget(budget *MemoryBudget) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.budget = budget
 }
 
+// SaveAt copies block into the piece buffer and feeds it to the piece hasher.
+// Blocks of verified pieces are dropped, so late duplicates do not allocate
+// buffer of piece that was already written out and released. Duplicates of
+// blocks that were already saved are dropped too, so bytes that went into
+// the hash are never rewritten.
 func (s *Storage) SaveAt(pIndex int, block []byte, offset int) {
-	buf := s.GetPieceData(pIndex)
-	copy(buf[offset:], block)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.verified[pIndex] {
+		return
+	}
+
+	ph := s.hashers[pIndex]
+	if ph == nil {
+		ph = newPieceHasher()
+		s.hashers[pIndex] = ph
+	}
+	if ph.has(offset) {
+		return
+	}
+
+	buf := s.getPieceData(pIndex)
+	n := copy(buf[offset:], block)
+	ph.write(buf[offset:offset+n], offset)
 }
 
 func (s *Storage) GetPieceData(pIndex int) []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.getPieceData(pIndex)
+}
+
+func (s *Storage) getPieceData(pIndex int) []byte {
 	buf := s.bufs[pIndex]
 
 	if buf == nil {
-		buf = make([]byte, PieceSize(s.tSize, s.pMaxSize, pIndex))
+		buf = make([]byte, s.layout.PieceSize(pIndex))
 		s.bufs[pIndex] = buf
 	}
 
 	return buf
 }
 
+// Verify compares hash with the digest accumulated while saving blocks.
+// Piece with blocks missing fails verification. Piece that fails
+// verification has its buffer released.
 func (s *Storage) Verify(pIndex int, hash [20]byte) bool {
-	buf := s.GetPieceData(pIndex)
-	pHash := sha1.Sum(buf)
+	s.Lock()
+	defer s.Unlock()
+
+	ph := s.hashers[pIndex]
 
-	return pHash == hash
+	var pHash [20]byte
+	if ph != nil && ph.offset == s.layout.PieceSize(pIndex) {
+		copy(pHash[:], ph.hash.Sum(nil))
+	}
+
+	if pHash != hash {
+		s.release(pIndex)
+		return false
+	}
+
+	s.verified[pIndex] = true
+	return true
+}
+
+// Unverify makes verified piece accept blocks again, so it can be
+// downloaded again.
+func (s *Storage) Unverify(pIndex int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.verified[pIndex] = false
+}
+
+// Discard drops partial data of piece without releasing memory budget, for
+// pieces whose reservation was already released.
+func (s *Storage) Discard(pIndex int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.bufs[pIndex] = nil
+	s.hashers[pIndex] = nil
+}
+
+// Release frees buffered piece data after it has been written out.
+func (s *Storage) Release(pIndex int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.release(pIndex)
+}
+
+func (s *Storage) release(pIndex int) {
+	buf := s.bufs[pIndex]
+	s.bufs[pIndex] = nil
+	s.hashers[pIndex] = nil
+
+	if buf != nil && s.budget != nil {
+		s.budget.Release(len(buf))
+	}
 }
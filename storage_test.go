@@ -0,0 +1,89 @@
+package gobt_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/edwces/gobt"
+)
+
+func TestStorageVerify(t *testing.T) {
+	data := make([]byte, TestTorrentPieceLength)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	hash := sha1.Sum(data)
+
+	tests := map[string]struct {
+		order []int
+		hash  [20]byte
+		want  bool
+	}{
+		"in order":      {order: []int{0, 1, 2, 3}, hash: hash, want: true},
+		"out of order":  {order: []int{2, 0, 3, 1}, hash: hash, want: true},
+		"duplicates":    {order: []int{1, 0, 1, 2, 0, 3}, hash: hash, want: true},
+		"invalid hash":  {order: []int{0, 1, 2, 3}, hash: [20]byte{}, want: false},
+		"missing block": {order: []int{0, 1, 3}, hash: hash, want: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := gobt.NewStorage(TestTorrentLayout)
+
+			for _, bi := range test.order {
+				offset := bi * gobt.MaxBlockLength
+				end := offset + gobt.MaxBlockLength
+				if end > len(data) {
+					end = len(data)
+				}
+				s.SaveAt(0, data[offset:end], offset)
+			}
+
+			if got := s.Verify(0, test.hash); got != test.want {
+				t.Fatalf("want %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestStorageSaveDuplicate(t *testing.T) {
+	data := make([]byte, TestTorrentPieceLength)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	garbage := make([]byte, gobt.MaxBlockLength)
+
+	tests := map[string]struct {
+		// order of blocks, duplicate is saved with garbage after the block
+		order     []int
+		duplicate int
+	}{
+		"hashed block": {order: []int{0, 1, 2, 3}, duplicate: 0},
+		"queued block": {order: []int{2, 0, 1, 3}, duplicate: 2},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := gobt.NewStorage(TestTorrentLayout)
+
+			for _, bi := range test.order {
+				offset := bi * gobt.MaxBlockLength
+				end := min(offset+gobt.MaxBlockLength, len(data))
+				s.SaveAt(0, data[offset:end], offset)
+
+				if bi == test.duplicate {
+					s.SaveAt(0, garbage[:end-offset], offset)
+				}
+			}
+
+			if !bytes.Equal(s.GetPieceData(0), data) {
+				t.Fatalf("want piece data unchanged by duplicate")
+			}
+
+			if !s.Verify(0, sha1.Sum(data)) {
+				t.Fatalf("want verified piece")
+			}
+		})
+	}
+}
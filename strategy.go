@@ -0,0 +1,149 @@
+package gobt
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/edwces/gobt/bitfield"
+)
+
+// PieceState describes piece as seen by a strategy.
+type PieceState struct {
+	Status       PieceStatus
+	Priority     Priority
+	Availability int
+}
+
+// PickState is read-only view of picker passed to strategy. It is only
+// valid for the duration of Choose call.
+type PickState interface {
+	// Count returns number of pieces in torrent.
+	Count() int
+	Piece(pi int) PieceState
+	// InProgress returns started pieces that still have blocks to request,
+	// by priority and then availability. The slice must not be modified.
+	InProgress() []int
+	// RangeQueued calls fn for pieces that are not started or skipped, by
+	// priority and then rarest first, until fn returns false.
+	RangeQueued(fn func(pi int) bool)
+	// RangeRandom is like RangeQueued, but pieces of the same priority are
+	// visited in random order.
+	RangeRandom(fn func(pi int) bool)
+	// Remaining returns number of pieces that are queued or in progress.
+	Remaining() int
+	// Started returns number of pieces that were started.
+	Started() int
+	// CanDuplicate reports whether pending piece has block that can also
+	// be requested from peer.
+	CanDuplicate(pi int, peer string) bool
+	Rand() *rand.Rand
+}
+
+// Strategy chooses piece that next block for peer is picked from. Picker
+// requests next queued block of chosen piece, or duplicates a pending block
+// if chosen piece has no queued blocks.
+type Strategy interface {
+	Choose(have bitfield.Bitfield, peer string, state PickState) (int, error)
+}
+
+// DefaultStrategy finishes started pieces first, starts the first few
+// pieces at random, then rarest first, and duplicates pending blocks once
+// every block has been requested.
+type DefaultStrategy struct{}
+
+func (DefaultStrategy) Choose(have bitfield.Bitfield, peer string, state PickState) (int, error) {
+	if state.Remaining() == 0 {
+		return chooseEndgame(have, peer, state)
+	}
+
+	pi, err := chooseStrict(have, state)
+	if err == nil {
+		return pi, nil
+	}
+
+	if state.Started() < RandomPieceEndCounter {
+		return chooseRandom(have, state)
+	}
+
+	return chooseRarest(have, state)
+}
+
+// SequentialStrategy finishes started pieces first and starts new pieces in
+// index order.
+type SequentialStrategy struct{}
+
+func (SequentialStrategy) Choose(have bitfield.Bitfield, peer string, state PickState) (int, error) {
+	if state.Remaining() == 0 {
+		return chooseEndgame(have, peer, state)
+	}
+
+	pi, err := chooseStrict(have, state)
+	if err == nil {
+		return pi, nil
+	}
+
+	for pi := 0; pi < state.Count(); pi++ {
+		piece := state.Piece(pi)
+
+		if piece.Status != PieceInQueue || piece.Priority == PrioritySkip {
+			continue
+		}
+
+		if has, _ := have.Get(pi); has {
+			return pi, nil
+		}
+	}
+
+	return 0, errors.New("No piece found")
+}
+
+func chooseStrict(have bitfield.Bitfield, state PickState) (int, error) {
+	for _, pi := range state.InProgress() {
+		if has, _ := have.Get(pi); has {
+			return pi, nil
+		}
+	}
+
+	return 0, errors.New("No pieces found")
+}
+
+// chooseRandom chooses random piece from the highest priority available.
+func chooseRandom(have bitfield.Bitfield, state PickState) (int, error) {
+	return chooseFirst(have, state.RangeRandom)
+}
+
+func chooseRarest(have bitfield.Bitfield, state PickState) (int, error) {
+	return chooseFirst(have, state.RangeQueued)
+}
+
+func chooseFirst(have bitfield.Bitfield, ranger func(fn func(pi int) bool)) (int, error) {
+	chosen := -1
+
+	ranger(func(pi int) bool {
+		if has, _ := have.Get(pi); has {
+			chosen = pi
+			return false
+		}
+		return true
+	})
+
+	if chosen == -1 {
+		return 0, errors.New("No piece found")
+	}
+
+	return chosen, nil
+}
+
+func chooseEndgame(have bitfield.Bitfield, peer string, state PickState) (int, error) {
+	for pi := 0; pi < state.Count(); pi++ {
+		if state.Piece(pi).Status != PiecePending {
+			continue
+		}
+
+		if has, _ := have.Get(pi); has && state.CanDuplicate(pi, peer) {
+			return pi, nil
+		}
+	}
+
+	return 0, errors.New("No piece found")
+}
@@ -0,0 +1,919 @@
+package gobt
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edwces/gobt/protocol"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	MaxPeerTimeout     = 2*time.Minute + 10*time.Second
+	KeepAlivePeriod    = 1*time.Minute + 30*time.Second
+	DefaultConnTimeout = 3 * time.Second
+	// How often outstanding requests are checked for timeout
+	RequestCheckPeriod = 5 * time.Second
+
+	// Wait before retrying failed announce, doubled after every failure
+	MinAnnounceRetry = 15 * time.Second
+	MaxAnnounceRetry = 30 * time.Minute
+	// Interval between announces if tracker sends none, and lowest interval
+	// tracker can ask for
+	DefaultAnnounceInterval = 30 * time.Minute
+	MinAnnounceInterval     = time.Minute
+)
+
+// ErrTorrentClosed is returned when starting torrent that was closed.
+var ErrTorrentClosed = errors.New("torrent closed")
+
+// Torrent downloads content of one metainfo into files in client directory.
+// Torrent is idle until started, and stops connecting to peers once every
+// wanted piece is verified.
+type Torrent struct {
+	client   *Client
+	metainfo *Metainfo
+	hash     [HashSize]byte
+	hashes   [][HashSize]byte
+	layout   Layout
+
+	picker  *Picker
+	storage *Storage
+	files   *FileStorage
+	peers   *PeersManager
+
+	maxConns    int
+	maxHalfOpen int
+
+	cancel   context.CancelFunc
+	stopped  chan struct{}
+	running  bool
+	incoming sync.WaitGroup
+	writes   sync.WaitGroup
+	complete chan struct{}
+	failed   chan struct{}
+	err      error
+	closed   bool
+	state    TorrentState
+	banned   map[string]struct{}
+	// Pieces of each file that are not verified yet
+	fileRemaining []int
+	// Files of verified pieces whose part was discarded because file was
+	// skipped, so piece is downloaded again once file is wanted
+	dropped map[int][]int
+	// blocks serializes saving blocks with marking them done, so piece is
+	// verified only once all its blocks are saved
+	blocks sync.Mutex
+	counts torrentCounts
+
+	mu sync.Mutex
+}
+
+// torrentCounts are totals of published events exposed as metrics.
+type torrentCounts struct {
+	verified      atomic.Int64
+	failed        atomic.Int64
+	trackerErrors atomic.Int64
+}
+
+func newTorrent(c *Client, m *Metainfo) (*Torrent, error) {
+	hash, err := m.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := m.PieceHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	layout := m.Layout()
+	err = layout.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hashes) != layout.PieceCount() {
+		return nil, fmt.Errorf("expected %d piece hashes, got %d", layout.PieceCount(), len(hashes))
+	}
+
+	t := &Torrent{
+		client:   c,
+		metainfo: m,
+		hash:     hash,
+		hashes:   hashes,
+		layout:   layout,
+		picker:   NewPicker(layout),
+		storage:  NewStorage(layout),
+		files:    NewFileStorage(c.dir, m.FileEntries()),
+		peers:    NewPeersManager(),
+		complete: make(chan struct{}),
+		failed:   make(chan struct{}),
+
+		maxConns:    DefaultMaxConns,
+		maxHalfOpen: DefaultMaxHalfOpen,
+	}
+
+	t.picker.SetMemoryBudget(c.budget)
+	t.storage.SetMemoryBudget(c.budget)
+	t.picker.SetFiles(t.files.Entries())
+	t.picker.SetLogger(t.log(LogPicker))
+	t.picker.OnDiscard(t.storage.Discard)
+	t.picker.SetPeerRates(t.peers)
+
+	t.banned = map[string]struct{}{}
+	t.dropped = map[int][]int{}
+	t.fileRemaining = make([]int, len(t.files.Entries()))
+	for fi, entry := range t.files.Entries() {
+		if entry.Length > 0 {
+			t.fileRemaining[fi] = layout.PieceAt(entry.Offset+entry.Length-1) - layout.PieceAt(entry.Offset) + 1
+		}
+	}
+
+	return t, nil
+}
+
+func (t *Torrent) InfoHash() [HashSize]byte {
+	return t.hash
+}
+
+func (t *Torrent) Name() string {
+	return t.metainfo.Info.Name
+}
+
+func (t *Torrent) Layout() Layout {
+	return t.layout
+}
+
+// Files returns files of torrent in content order.
+func (t *Torrent) Files() []FileEntry {
+	return t.files.Entries()
+}
+
+// SetFilePriority sets priority of file. Skipped files are not downloaded
+// and never created on disk.
+func (t *Torrent) SetFilePriority(fi int, priority Priority) {
+	// Block being saved must not be saved into discarded piece
+	t.blocks.Lock()
+	defer t.blocks.Unlock()
+
+	skipped := t.picker.FilePriority(fi) == PrioritySkip
+	t.picker.SetFilePriority(fi, priority)
+	t.files.SetWanted(fi, priority != PrioritySkip)
+
+	if skipped && priority != PrioritySkip {
+		t.requeueDropped(fi)
+	}
+
+	t.peers.UpdateInterest()
+}
+
+// SetSequential makes torrent download pieces in order.
+func (t *Torrent) SetSequential(sequential bool) {
+	t.picker.SetSequential(sequential)
+}
+
+// SetStrategy replaces strategy used to choose pieces.
+func (t *Torrent) SetStrategy(strategy Strategy) {
+	t.picker.SetStrategy(strategy)
+}
+
+// SetPiecePriority sets priority of single piece, overriding priority of
+// its files.
+func (t *Torrent) SetPiecePriority(pi int, priority Priority) {
+	// Block being saved must not be saved into discarded piece
+	t.blocks.Lock()
+	defer t.blocks.Unlock()
+
+	t.picker.SetPiecePriority(pi, priority)
+
+	t.peers.UpdateInterest()
+}
+
+// SetPieceDeadline asks for piece to be verified within duration.
+func (t *Torrent) SetPieceDeadline(pi int, within time.Duration) {
+	t.picker.SetPieceDeadline(pi, within)
+}
+
+// ClearPieceDeadline removes deadline of piece.
+func (t *Torrent) ClearPieceDeadline(pi int) {
+	t.picker.ClearPieceDeadline(pi)
+}
+
+// SetMaxConns sets number of connected peers of torrent, applied when
+// torrent starts.
+func (t *Torrent) SetMaxConns(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.maxConns = n
+}
+
+// SetMaxHalfOpen sets number of connections torrent dials at once, applied
+// when torrent starts.
+func (t *Torrent) SetMaxHalfOpen(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.maxHalfOpen = n
+}
+
+// Progress returns number of verified pieces and number of wanted pieces.
+func (t *Torrent) Progress() (int, int) {
+	return t.picker.WantedProgress()
+}
+
+// Stats returns transfer of all peers of torrent.
+func (t *Torrent) Stats() TransferStats {
+	return t.peers.Stats()
+}
+
+// PeerStats returns snapshot of every connected peer, ordered by address.
+func (t *Torrent) PeerStats() []PeerStats {
+	return t.peers.PeerStats()
+}
+
+// Limit returns bandwidth limit shared by all peers of torrent.
+func (t *Torrent) Limit() *BandwidthLimit {
+	return t.peers.Limit()
+}
+
+// NewReader creates reader over torrent content that prioritises pieces
+// around its read position.
+func (t *Torrent) NewReader() *Reader {
+	return NewReader(t.files, t.picker, t.layout)
+}
+
+// Handler returns HTTP handler serving files of torrent.
+func (t *Torrent) Handler() *Handler {
+	return NewHandler(t.files.Entries(), t.files, t.picker, t.layout)
+}
+
+// Start announces torrent to tracker and connects to peers in background
+// until ctx is done, torrent is paused or closed, or download completes.
+// Starting running torrent does nothing.
+func (t *Torrent) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return ErrTorrentClosed
+	}
+	if t.err != nil {
+		return t.err
+	}
+
+	if t.stopped != nil {
+		select {
+		case <-t.stopped:
+		default:
+			return nil
+		}
+	}
+
+	if t.isComplete() {
+		return nil
+	}
+
+	cm := NewConnManager(t.client.dialer(), t.handle)
+	cm.SetMaxConns(t.maxConns)
+	cm.SetMaxHalfOpen(t.maxHalfOpen)
+	cm.SetSharedLimit(t.client.conns)
+	cm.SetLocalPort(t.client.Port())
+
+	ctx, t.cancel = context.WithCancel(ctx)
+	t.stopped = make(chan struct{})
+	t.running = true
+	t.setState(StateDownloading)
+	go t.run(ctx, cm, t.stopped)
+
+	return nil
+}
+
+// Pause disconnects all peers and waits until torrent stops. Downloaded
+// pieces are kept, so torrent can be started again.
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	cancel, stopped := t.cancel, t.stopped
+	t.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-stopped
+}
+
+// Wait blocks until every wanted piece is verified, torrent fails or ctx is
+// done.
+func (t *Torrent) Wait(ctx context.Context) error {
+	select {
+	case <-t.complete:
+		return nil
+	case <-t.failed:
+		return t.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// State returns whether torrent is stopped, downloading, complete or failed.
+func (t *Torrent) State() TorrentState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.state
+}
+
+// Subscribe returns subscription to events of torrent with room for buffer
+// events.
+func (t *Torrent) Subscribe(buffer int) *Subscription {
+	return t.client.events.subscribe(buffer, t.isOwnEvent)
+}
+
+// OnEvent calls fn with every event of torrent. Calls are made from
+// goroutine of subscription, one at a time, and never block torrent.
+func (t *Torrent) OnEvent(fn func(e Event)) *Subscription {
+	return t.client.events.onEvent(fn, t.isOwnEvent)
+}
+
+func (t *Torrent) isOwnEvent(e Event) bool {
+	return e.Torrent == t.hash
+}
+
+func (t *Torrent) publish(e Event) {
+	switch {
+	case e.Type == EventPieceVerified:
+		t.counts.verified.Add(1)
+	case e.Type == EventPieceFailed:
+		t.counts.failed.Add(1)
+	case e.Type == EventAnnounce && e.Err != nil:
+		t.counts.trackerErrors.Add(1)
+	}
+
+	e.Torrent = t.hash
+	t.client.events.publish(e)
+}
+
+// log returns logger of subsystem with torrent attributes.
+func (t *Torrent) log(subsystem string) *slog.Logger {
+	return t.client.log(subsystem).With("torrent", hex.EncodeToString(t.hash[:]), "name", t.metainfo.Info.Name)
+}
+
+// setState changes state and publishes it. Caller must hold mu.
+func (t *Torrent) setState(state TorrentState) {
+	if t.state == state {
+		return
+	}
+
+	t.state = state
+	t.publish(Event{Type: EventStateChanged, State: state})
+}
+
+// Err returns error that stopped torrent, such as failed tracker announce
+// or failed write to disk.
+func (t *Torrent) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.err
+}
+
+// Close stops torrent, removes it from client and closes its files.
+func (t *Torrent) Close() error {
+	t.shutdown()
+	return t.files.Close()
+}
+
+// Remove stops torrent, removes it from client and deletes its files.
+func (t *Torrent) Remove() error {
+	t.shutdown()
+	return t.files.Remove()
+}
+
+func (t *Torrent) shutdown() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	t.Pause()
+	t.client.remove(t)
+
+	// Pieces must be written before files are closed
+	t.writes.Wait()
+
+	// Memory budget is shared with other torrents of client, so
+	// reservations of unfinished pieces are given back
+	t.blocks.Lock()
+	t.picker.DiscardStarted()
+	t.blocks.Unlock()
+}
+
+func (t *Torrent) isComplete() bool {
+	select {
+	case <-t.complete:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop makes torrent stop without waiting, so it can be called from peer
+// sessions.
+func (t *Torrent) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+func (t *Torrent) fail(err error) {
+	t.mu.Lock()
+	if t.err == nil {
+		t.err = err
+		close(t.failed)
+		t.setState(StateFailed)
+	}
+	t.mu.Unlock()
+
+	t.stop()
+}
+
+func (t *Torrent) run(ctx context.Context, cm *ConnManager, stopped chan struct{}) {
+	defer close(stopped)
+	defer t.disconnectIncoming()
+
+	go t.resumeRequests(ctx.Done())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.announce(ctx, cm)
+	}()
+
+	cm.Run(ctx.Done())
+	wg.Wait()
+}
+
+// announce receives peers from tracker and adds them to cm until ctx is
+// done. Tracker is announced to again on its interval, so candidates that
+// were dropped after failing are added back. Failed announce is retried
+// with backoff, so tracker outage only delays download.
+func (t *Torrent) announce(ctx context.Context, cm *ConnManager) {
+	retry := MinAnnounceRetry
+
+	for {
+		stats := t.Stats()
+		ann, err := Announce(ctx, t.metainfo.Announce, t.hash, t.client.peerID, AnnounceStats{
+			Uploaded:   stats.Uploaded,
+			Downloaded: stats.Downloaded,
+			Left:       t.picker.Left(),
+		}, t.client.Port())
+		if ctx.Err() != nil {
+			return
+		}
+
+		var wait time.Duration
+		if err == nil {
+			t.publish(Event{Type: EventAnnounce, Peers: len(ann.Peers)})
+
+			for _, peer := range ann.Peers {
+				cm.Add(peer.Addr())
+			}
+
+			wait = announceInterval(ann.Interval)
+			retry = MinAnnounceRetry
+			t.log(LogTracker).Debug("announced", "tracker", t.metainfo.Announce, "peers", len(ann.Peers), "next", wait)
+		} else {
+			t.publish(Event{Type: EventAnnounce, Err: err})
+
+			wait = retry
+			retry = min(2*retry, MaxAnnounceRetry)
+			t.log(LogTracker).Warn("announce failed", "tracker", t.metainfo.Announce, "err", err, "retry", wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// announceInterval returns wait before next announce from interval in
+// seconds sent by tracker.
+func announceInterval(seconds int) time.Duration {
+	if seconds <= 0 {
+		return DefaultAnnounceInterval
+	}
+
+	return max(time.Duration(seconds)*time.Second, MinAnnounceInterval)
+}
+
+// accept runs session with peer that connected to client, if torrent is
+// running.
+func (t *Torrent) accept(peer *Peer) {
+	t.mu.Lock()
+	if !t.running {
+		t.mu.Unlock()
+		return
+	}
+	t.incoming.Add(1)
+	t.mu.Unlock()
+
+	defer t.incoming.Done()
+	t.session(peer)
+}
+
+// disconnectIncoming closes connections of peers that connected to client
+// and waits for their sessions, once torrent stops.
+func (t *Torrent) disconnectIncoming() {
+	t.mu.Lock()
+	t.running = false
+	if t.state == StateDownloading {
+		t.setState(StateStopped)
+	}
+	t.mu.Unlock()
+
+	t.peers.Disconnect()
+	t.incoming.Wait()
+}
+
+// handle runs session with peer that client connected to.
+func (t *Torrent) handle(peer *Peer) {
+	// Peer that accepted connection but never answers must not hold it
+	peer.SetReadDeadline(MaxPeerTimeout)
+	err := peer.Handshake(t.hash, t.client.peerID)
+	if err != nil {
+		t.log(LogWire).Debug("handshake failed", "peer", peer.String(), "err", err)
+		return
+	}
+
+	t.session(peer)
+}
+
+// session exchanges messages with peer until connection fails.
+func (t *Torrent) session(peer *Peer) {
+	if t.isBanned(peer) {
+		return
+	}
+
+	logger := t.log(LogWire).With("peer", peer.String(), "client", peer.ClientName())
+	peer.SetLogger(logger)
+	logger.Debug("connected")
+
+	t.peers.Add(peer)
+	peer.TrackPieces(t.layout.PieceCount(), t.picker.IsWanted)
+	t.publish(Event{Type: EventPeerConnected, Peer: peer.String()})
+
+	done := make(chan struct{})
+	peer.KeepAlive(KeepAlivePeriod)
+	go t.expireRequests(peer, done)
+
+	// Extension handshake tells how many requests peer keeps
+	if peer.SupportsExtensions() {
+		err := peer.SendExtHandshake()
+		if err != nil {
+			logger.Debug("extension handshake failed", "err", err)
+		}
+	}
+
+	err := t.exchange(peer)
+	logger.Debug("disconnected", "err", err)
+
+	close(done)
+	for _, req := range peer.Requests() {
+		t.picker.FailPendingBlock(req.Index, t.layout.BlockAt(req.Offset), peer.String())
+	}
+	t.picker.DecrementAvailability(peer.Pieces())
+	t.peers.Remove(peer)
+
+	t.publish(Event{Type: EventPeerDisconnected, Peer: peer.String(), Err: err})
+}
+
+// exchange runs message loop of peer. It returns error that ended
+// connection.
+func (t *Torrent) exchange(peer *Peer) error {
+	for {
+		peer.SetReadDeadline(MaxPeerTimeout)
+		prev := peer.State()
+		msg, err := peer.ReadMsg()
+
+		if err != nil {
+			return err
+		}
+
+		if msg.KeepAlive {
+			continue
+		}
+
+		switch msg.ID {
+		case protocol.IDPiece:
+			block := msg.Payload.Block()
+
+			err := peer.RecvRequest(int(block.Index), int(block.Offset), len(block.Block))
+			// Unrequested and cancelled blocks are dropped and counted as
+			// wasted
+			if err == nil {
+				err = t.recvBlock(peer, int(block.Index), int(block.Offset), block.Block)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = t.request(peer, nil)
+			if err != nil {
+				return err
+			}
+		case protocol.IDUnchoke:
+			unresolved := []BlockRequest{}
+			if prev.PeerChoking {
+				// Choking peer discarded our requests
+				unresolved = peer.ClearRequests()
+			}
+
+			err := t.request(peer, unresolved)
+			if err != nil {
+				return err
+			}
+		case protocol.IDHave, protocol.IDBitfield:
+			// Peer pieces and interest are updated by ReadMsg
+			if msg.ID == protocol.IDHave {
+				t.picker.IncrementPieceAvailability(int(msg.Payload.Have()))
+			} else {
+				t.picker.IncrementAvailability(peer.Pieces())
+			}
+
+			// Peer that already unchoked us may become interesting again
+			if !prev.AmInterested {
+				err := t.request(peer, nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// recvBlock stores requested block and verifies piece once all its blocks
+// are received. It returns error if peer should be disconnected.
+func (t *Torrent) recvBlock(peer *Peer, index, offset int, data []byte) error {
+	t.blocks.Lock()
+	defer t.blocks.Unlock()
+
+	bi := t.layout.BlockAt(offset)
+	// Duplicate of block another peer sent first
+	if !t.picker.IsBlockWanted(index, bi) {
+		return nil
+	}
+
+	// Store block before it is marked done
+	t.storage.SaveAt(index, data, offset)
+
+	cancel := t.picker.MarkBlockDone(index, bi, peer.String())
+	t.peers.WriteCancel(index, offset, len(data), cancel)
+
+	if !t.picker.IsPieceDone(index) {
+		return nil
+	}
+
+	if !t.storage.Verify(index, t.hashes[index]) {
+		t.picker.FailPendingPiece(index)
+		t.publish(Event{Type: EventPieceFailed, Piece: index, Peer: peer.String()})
+		t.log(LogStorage).Warn("piece failed hash check", "piece", index, "peer", peer.String(), "client", peer.ClientName())
+
+		peer.HashFails += 1
+		if peer.HashFails >= MaxHashFails {
+			err := fmt.Errorf("exceeded maximum hash fails: %d", MaxHashFails)
+			t.ban(peer, err)
+			return err
+		}
+
+		return nil
+	}
+
+	t.writes.Add(1)
+	from := peer.String()
+	t.client.disk.submit(func() {
+		defer t.writes.Done()
+		t.writePiece(index, from)
+	})
+
+	return nil
+}
+
+// writePiece writes verified piece to files and announces it to peers
+// other than peer it came from.
+func (t *Torrent) writePiece(index int, from string) {
+	_, dropped, err := t.files.writeAt(t.storage.GetPieceData(index), t.layout.PieceOffset(index))
+	t.storage.Release(index)
+	if err != nil {
+		t.publish(Event{Type: EventStorageError, Piece: index, Err: err})
+		t.log(LogStorage).Error("write failed", "piece", index, "err", err)
+		t.fail(err)
+		return
+	}
+	t.picker.MarkPieceVerified(index)
+	t.publish(Event{Type: EventPieceVerified, Piece: index, Peer: from})
+	t.log(LogStorage).Debug("piece verified", "piece", index, "peer", from)
+	t.completeFiles(index, dropped)
+
+	t.peers.WriteHave(index, from)
+	t.peers.Unwant(index)
+
+	if done, wanted := t.picker.WantedProgress(); done == wanted {
+		t.mu.Lock()
+		if !t.isComplete() {
+			close(t.complete)
+			t.setState(StateComplete)
+		}
+		t.mu.Unlock()
+
+		t.stop()
+	}
+}
+
+// request sends requests until peer queue is full, resending unresolved
+// requests first.
+func (t *Torrent) request(peer *Peer, unresolved []BlockRequest) error {
+	have := peer.Pieces()
+
+	for peer.IsRequestable() {
+		var req BlockRequest
+
+		if len(unresolved) == 0 {
+			pi, bi, err := t.picker.Pick(have, peer.String())
+
+			if errors.Is(err, ErrMemoryBudget) {
+				return nil
+			}
+			if err != nil {
+				// Wanted pieces of peer may all be started already, so
+				// interest is kept until they are verified
+				return nil
+			}
+
+			req = t.layout.Request(pi, bi)
+		} else {
+			req = unresolved[0]
+			unresolved = unresolved[1:]
+		}
+
+		err := peer.SendRequest(req.Index, req.Offset, req.Length)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// completeFiles publishes completion of files that verified piece was the
+// last missing piece of. Files whose part of piece was dropped are not
+// counted, and piece that was verified before counts only files that were
+// dropped then.
+func (t *Torrent) completeFiles(index int, dropped []int) {
+	start, end := t.layout.PieceOffset(index), t.layout.PieceOffset(index)+int64(t.layout.PieceSize(index))
+	completed := []int{}
+
+	// Files are in content order, so first file ending after piece start
+	// is the first file of piece
+	entries := t.files.Entries()
+	first := sort.Search(len(entries), func(fi int) bool {
+		return entries[fi].Offset+entries[fi].Length > start
+	})
+
+	t.mu.Lock()
+	// Files that were written before were already counted
+	uncounted, again := t.dropped[index]
+	delete(t.dropped, index)
+
+	for fi := first; fi < len(entries) && entries[fi].Offset < end; fi++ {
+		if entries[fi].Length == 0 || again && !slices.Contains(uncounted, fi) {
+			continue
+		}
+
+		if slices.Contains(dropped, fi) {
+			t.dropped[index] = append(t.dropped[index], fi)
+			continue
+		}
+
+		t.fileRemaining[fi]--
+		if t.fileRemaining[fi] == 0 {
+			completed = append(completed, fi)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, fi := range completed {
+		t.publish(Event{Type: EventFileCompleted, File: fi})
+	}
+}
+
+// requeueDropped downloads again verified pieces whose part of file was
+// dropped while file was skipped. Caller must hold blocks.
+func (t *Torrent) requeueDropped(fi int) {
+	t.mu.Lock()
+	pieces := []int{}
+	for pi, files := range t.dropped {
+		if slices.Contains(files, fi) {
+			pieces = append(pieces, pi)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, pi := range pieces {
+		t.storage.Unverify(pi)
+		t.picker.Unverify(pi)
+	}
+}
+
+// ban disconnects peer and refuses its connections from now on.
+func (t *Torrent) ban(peer *Peer, err error) {
+	t.mu.Lock()
+	t.banned[peerHost(peer)] = struct{}{}
+	t.mu.Unlock()
+
+	t.publish(Event{Type: EventPeerBanned, Peer: peer.String(), Err: err})
+	t.log(LogWire).Info("peer banned", "peer", peer.String(), "client", peer.ClientName(), "err", err)
+}
+
+func (t *Torrent) isBanned(peer *Peer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.banned[peerHost(peer)]
+	return ok
+}
+
+func peerHost(peer *Peer) string {
+	host, _, err := net.SplitHostPort(peer.String())
+	if err != nil {
+		return peer.String()
+	}
+
+	return host
+}
+
+// resumeRequests requests blocks from idle peers whenever memory budget is
+// released. Peers stop requesting when no piece fits into budget, and no
+// message of peer would make them request again.
+func (t *Torrent) resumeRequests(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.client.budget.Released():
+		}
+
+		t.peers.rangePeers(func(peer *Peer) {
+			if !peer.IsRequestable() || len(peer.Requests()) > 0 {
+				return
+			}
+
+			err := t.request(peer, nil)
+			if err != nil {
+				peer.Close()
+			}
+		})
+	}
+}
+
+// expireRequests returns blocks of timed out requests so other peers can
+// pick them, until done is closed.
+func (t *Torrent) expireRequests(peer *Peer, done <-chan struct{}) {
+	ticker := time.NewTicker(RequestCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			for _, req := range peer.ExpireRequests(now, peer.DownloadRate()) {
+				err := peer.SendCancel(req.Index, req.Offset, req.Length)
+				if err != nil {
+					peer.Close()
+					return
+				}
+				t.picker.FailPendingBlock(req.Index, t.layout.BlockAt(req.Offset), peer.String())
+			}
+		}
+	}
+}
+
+func dialTimeout(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, DefaultConnTimeout)
+}
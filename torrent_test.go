@@ -0,0 +1,778 @@
+package gobt_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edwces/gobt"
+	"github.com/edwces/gobt/protocol"
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const TestSeedLength = 5*gobt.MaxBlockLength + 100
+
+// newTestSwarm creates metainfo of content announced to tracker whose only
+// peer seeds the content.
+func newTestSwarm(t *testing.T, name string, content []byte) *gobt.Metainfo {
+	return newTestSwarmWith(t, name, nil, content, seed)
+}
+
+// newTestSwarmWith creates metainfo of content split into files, or single
+// file if files are nil, announced to tracker whose only peer is served by
+// serve.
+func newTestSwarmWith(t *testing.T, name string, files []gobt.File, content []byte, serve func(conn net.Conn, hash [20]byte, content []byte, pieceLength int)) *gobt.Metainfo {
+	m := &gobt.Metainfo{}
+	m.Info.Name = name
+	m.Info.Files = files
+	if files == nil {
+		m.Info.Length = int64(len(content))
+	}
+	m.Info.PieceLength = 2 * gobt.MaxBlockLength
+
+	for offset := 0; offset < len(content); offset += int(m.Info.PieceLength) {
+		end := offset + int(m.Info.PieceLength)
+		if end > len(content) {
+			end = len(content)
+		}
+
+		hash := sha1.Sum(content[offset:end])
+		m.Info.Pieces += string(hash[:])
+	}
+
+	hash, err := m.InfoHash()
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go serve(conn, hash, content, int(m.Info.PieceLength))
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := strconv.Atoi(port)
+		bencode.Marshal(w, gobt.AnnounceResponse{Interval: 1800, Peers: []gobt.AnnouncePeer{{ID: "seed", IP: host, Port: p}}})
+	}))
+	t.Cleanup(tracker.Close)
+
+	m.Announce = tracker.URL
+	return m
+}
+
+// seed serves every request of peer from content.
+func seed(conn net.Conn, hash [20]byte, content []byte, pieceLength int) {
+	defer conn.Close()
+
+	if !greet(conn, hash, content, pieceLength) {
+		return
+	}
+
+	for {
+		msg, err := protocol.UnmarshalMessage(conn)
+		if err != nil {
+			return
+		}
+
+		if msg.KeepAlive || msg.ID != protocol.IDRequest {
+			continue
+		}
+
+		serveBlock(conn, content, pieceLength, msg.Payload.Request())
+	}
+}
+
+// serveBlock answers request with block of content.
+func serveBlock(conn net.Conn, content []byte, pieceLength int, req protocol.Request) {
+	offset := int(req.Index)*pieceLength + int(req.Offset)
+	block := protocol.Block{Index: req.Index, Offset: req.Offset, Block: content[offset : offset+int(req.Length)]}
+	conn.Write((&protocol.Message{ID: protocol.IDPiece, Payload: block.Marshal()}).Marshal())
+}
+
+// hold returns seed that answers requests of piece held only once release
+// is closed.
+func hold(held int, release chan struct{}) func(conn net.Conn, hash [20]byte, content []byte, pieceLength int) {
+	return func(conn net.Conn, hash [20]byte, content []byte, pieceLength int) {
+		defer conn.Close()
+
+		if !greet(conn, hash, content, pieceLength) {
+			return
+		}
+
+		var mu sync.Mutex
+		released := false
+		pending := []protocol.Request{}
+
+		go func() {
+			<-release
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			released = true
+			for _, req := range pending {
+				serveBlock(conn, content, pieceLength, req)
+			}
+		}()
+
+		for {
+			msg, err := protocol.UnmarshalMessage(conn)
+			if err != nil {
+				return
+			}
+
+			if msg.KeepAlive || msg.ID != protocol.IDRequest {
+				continue
+			}
+
+			mu.Lock()
+			if req := msg.Payload.Request(); int(req.Index) == held && !released {
+				pending = append(pending, req)
+			} else {
+				serveBlock(conn, content, pieceLength, req)
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// stall returns seed that announces every piece but never sends blocks.
+// requested is closed on the first request.
+func stall(requested chan struct{}) func(conn net.Conn, hash [20]byte, content []byte, pieceLength int) {
+	var once sync.Once
+
+	return func(conn net.Conn, hash [20]byte, content []byte, pieceLength int) {
+		defer conn.Close()
+
+		if !greet(conn, hash, content, pieceLength) {
+			return
+		}
+
+		for {
+			msg, err := protocol.UnmarshalMessage(conn)
+			if err != nil {
+				return
+			}
+
+			if !msg.KeepAlive && msg.ID == protocol.IDRequest {
+				once.Do(func() { close(requested) })
+			}
+		}
+	}
+}
+
+// greet exchanges handshake with peer and tells it that every piece is
+// available.
+func greet(conn net.Conn, hash [20]byte, content []byte, pieceLength int) bool {
+	if _, err := protocol.UnmarshalHandshake(conn); err != nil {
+		return false
+	}
+	conn.Write(protocol.NewHandshake(hash, [20]byte{1}).Marshal())
+
+	count := (len(content) + pieceLength - 1) / pieceLength
+	bf := make([]byte, (count+7)/8)
+	for pi := 0; pi < count; pi++ {
+		bf[pi/8] |= 1 << (7 - pi%8)
+	}
+
+	conn.Write((&protocol.Message{ID: protocol.IDBitfield, Payload: bf}).Marshal())
+	conn.Write((&protocol.Message{ID: protocol.IDUnchoke}).Marshal())
+
+	return true
+}
+
+// newTestClient creates client downloading into temporary directory. Client
+// is closed when test ends.
+func newTestClient(t *testing.T) (*gobt.Client, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	client, err := gobt.NewClient(dir)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client, dir
+}
+
+// startTestTorrent adds torrent of m to client and starts it. Setup, if not
+// nil, is called before torrent starts, such as to subscribe to its events.
+func startTestTorrent(t *testing.T, ctx context.Context, client *gobt.Client, m *gobt.Metainfo, setup func(torrent *gobt.Torrent)) *gobt.Torrent {
+	t.Helper()
+
+	torrent, err := client.AddTorrent(m)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if setup != nil {
+		setup(torrent)
+	}
+
+	err = torrent.Start(ctx)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	return torrent
+}
+
+// downloadTestTorrent is startTestTorrent that waits until every wanted
+// piece of torrent is verified.
+func downloadTestTorrent(t *testing.T, ctx context.Context, client *gobt.Client, m *gobt.Metainfo, setup func(torrent *gobt.Torrent)) *gobt.Torrent {
+	t.Helper()
+
+	torrent := startTestTorrent(t, ctx, client, m, setup)
+
+	err := torrent.Wait(ctx)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	return torrent
+}
+
+func TestTorrentDownload(t *testing.T) {
+	content := make([]byte, TestSeedLength)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	tests := map[string]struct {
+		memoryLimit int
+	}{
+		"default memory limit": {memoryLimit: gobt.DefaultMemoryLimit},
+		// Peer waits for budget after every piece
+		"memory limit of one piece": {memoryLimit: 2 * gobt.MaxBlockLength},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client, dir := newTestClient(t)
+			client.SetMemoryLimit(test.memoryLimit)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			torrent := downloadTestTorrent(t, ctx, client, newTestSwarm(t, "content", content), nil)
+
+			if done, wanted := torrent.Progress(); done != wanted || wanted != torrent.Layout().PieceCount() {
+				t.Fatalf("want %d pieces, got %d of %d", torrent.Layout().PieceCount(), done, wanted)
+			}
+
+			err := torrent.Close()
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "content"))
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			if !bytes.Equal(got, content) {
+				t.Fatalf("want downloaded file equal to content")
+			}
+
+			if err := torrent.Start(ctx); !errors.Is(err, gobt.ErrTorrentClosed) {
+				t.Fatalf("want ErrTorrentClosed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTorrentRemoveReleasesMemory(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	requested := make(chan struct{})
+	torrent := startTestTorrent(t, ctx, client, newTestSwarmWith(t, "content", nil, make([]byte, TestSeedLength), stall(requested)), nil)
+
+	select {
+	case <-requested:
+	case <-ctx.Done():
+		t.Fatalf("want request, got %s", ctx.Err())
+	}
+
+	if used, _ := client.MemoryUsage(); used == 0 {
+		t.Fatalf("want reserved memory while downloading, got 0")
+	}
+
+	err := torrent.Remove()
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if used, _ := client.MemoryUsage(); used != 0 {
+		t.Fatalf("want 0, got %d", used)
+	}
+}
+
+func TestTorrentUnskipFile(t *testing.T) {
+	content := make([]byte, TestSeedLength)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	// Piece 1 is shared by all files, piece 2 is held until b is wanted
+	files := []gobt.File{
+		{Length: 40000, Path: []string{"a"}},
+		{Length: 10000, Path: []string{"b"}},
+		{Length: TestSeedLength - 50000, Path: []string{"c"}},
+	}
+
+	client, dir := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	release := make(chan struct{})
+	var sub *gobt.Subscription
+	torrent := startTestTorrent(t, ctx, client, newTestSwarmWith(t, "content", files, content, hold(2, release)), func(torrent *gobt.Torrent) {
+		torrent.SetFilePriority(1, gobt.PrioritySkip)
+		sub = torrent.Subscribe(gobt.DefaultEventBuffer)
+	})
+
+	verified := map[int]bool{}
+	completed := map[int]int{}
+	for !verified[0] || !verified[1] {
+		select {
+		case e := <-sub.Events():
+			switch e.Type {
+			case gobt.EventPieceVerified:
+				verified[e.Piece] = true
+			case gobt.EventFileCompleted:
+				completed[e.File]++
+			}
+		case <-ctx.Done():
+			t.Fatalf("want pieces 0 and 1 verified, got %s", ctx.Err())
+		}
+	}
+
+	// Part of b in piece 1 was dropped, so piece is downloaded again
+	torrent.SetFilePriority(1, gobt.PriorityNormal)
+	close(release)
+
+	err := torrent.Wait(ctx)
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	// Closing client closes subscriptions
+	client.Close()
+
+	for e := range sub.Events() {
+		if e.Type == gobt.EventFileCompleted {
+			completed[e.File]++
+		}
+	}
+
+	for fi := range files {
+		if completed[fi] != 1 {
+			t.Fatalf("want file %d completed once, got %d", fi, completed[fi])
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "content", "b"))
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if !bytes.Equal(got, content[40000:50000]) {
+		t.Fatalf("want file b equal to its content")
+	}
+}
+
+func TestClientAddTorrent(t *testing.T) {
+	client, err := gobt.NewClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+	defer client.Close()
+
+	m := newTestSwarm(t, "content", make([]byte, TestSeedLength))
+
+	if _, err := client.AddTorrent(m); err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if _, err := client.AddTorrent(m); !errors.Is(err, gobt.ErrTorrentExists) {
+		t.Fatalf("want ErrTorrentExists, got %v", err)
+	}
+
+	if torrents := client.Torrents(); len(torrents) != 1 {
+		t.Fatalf("want 1 torrent, got %d", len(torrents))
+	}
+}
+
+func TestClientSession(t *testing.T) {
+	client, dir := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	contents := map[string][]byte{"first": make([]byte, TestSeedLength), "second": make([]byte, 2*TestSeedLength)}
+	torrents := []*gobt.Torrent{}
+
+	for name, content := range contents {
+		for i := range content {
+			content[i] = byte(len(name) + i)
+		}
+
+		torrents = append(torrents, startTestTorrent(t, ctx, client, newTestSwarm(t, name, content), nil))
+	}
+
+	for _, torrent := range torrents {
+		err := torrent.Wait(ctx)
+		if err != nil {
+			t.Fatalf("%s: want nil, got err: %s", torrent.Name(), err.Error())
+		}
+	}
+
+	err := client.Close()
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if conns, halfOpen := client.ConnLimit().Conns(); conns != 0 || halfOpen != 0 {
+		t.Fatalf("want no connections after close, got %d, %d half open", conns, halfOpen)
+	}
+
+	for name, content := range contents {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("want nil, got err: %s", err.Error())
+		}
+
+		if !bytes.Equal(got, content) {
+			t.Fatalf("%s: want downloaded file equal to content", name)
+		}
+	}
+}
+
+func TestClientListen(t *testing.T) {
+	client, err := gobt.NewClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+	defer client.Close()
+
+	err = client.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	torrent, err := client.AddTorrent(newTestSwarm(t, "content", make([]byte, TestSeedLength)))
+	if err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	tests := map[string]struct {
+		hash   [20]byte
+		answer bool
+	}{
+		"known torrent":   {hash: torrent.InfoHash(), answer: true},
+		"unknown torrent": {hash: [20]byte{1}, answer: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(client.Port())))
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+			defer conn.Close()
+
+			conn.Write(protocol.NewHandshake(test.hash, [20]byte{2}).Marshal())
+			hs, err := protocol.UnmarshalHandshake(conn)
+
+			if !test.answer {
+				if err == nil {
+					t.Fatalf("want connection closed, got handshake")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+
+			if hs.InfoHash != test.hash || hs.PeerID != client.PeerID() {
+				t.Fatalf("want handshake of client for torrent, got %+v", hs)
+			}
+		})
+	}
+}
+
+func TestTorrentEvents(t *testing.T) {
+	client, _ := newTestClient(t)
+	small := client.Subscribe(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sub *gobt.Subscription
+	torrent := downloadTestTorrent(t, ctx, client, newTestSwarm(t, "content", make([]byte, TestSeedLength)), func(torrent *gobt.Torrent) {
+		sub = torrent.Subscribe(gobt.DefaultEventBuffer)
+	})
+
+	// Closing client closes subscriptions
+	client.Close()
+
+	counts := map[gobt.EventType]int{}
+	states := []gobt.TorrentState{}
+	for e := range sub.Events() {
+		if e.Torrent != torrent.InfoHash() {
+			t.Fatalf("want event of torrent, got %+v", e)
+		}
+
+		counts[e.Type]++
+		if e.Type == gobt.EventStateChanged {
+			states = append(states, e.State)
+		}
+		if e.Type == gobt.EventAnnounce && (e.Err != nil || e.Peers != 1) {
+			t.Fatalf("want announce with 1 peer, got %+v", e)
+		}
+	}
+
+	want := map[gobt.EventType]int{
+		gobt.EventStateChanged:     2,
+		gobt.EventAnnounce:         1,
+		gobt.EventPeerConnected:    1,
+		gobt.EventPeerDisconnected: 1,
+		gobt.EventPieceVerified:    torrent.Layout().PieceCount(),
+		gobt.EventFileCompleted:    1,
+	}
+
+	for typ, n := range want {
+		if counts[typ] != n {
+			t.Fatalf("want %d %s events, got %d", n, typ.String(), counts[typ])
+		}
+	}
+
+	if len(states) != 2 || states[0] != gobt.StateDownloading || states[1] != gobt.StateComplete {
+		t.Fatalf("want downloading then complete, got %v", states)
+	}
+
+	if small.Dropped() == 0 {
+		t.Fatalf("want dropped events of full subscription, got none")
+	}
+}
+
+// syncBuffer collects log output written from many goroutines.
+type syncBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestClientLogLevels(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	out := &syncBuffer{}
+	client.SetLogger(slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: gobt.LevelTrace})))
+	client.SetLogLevel(gobt.LogWire, gobt.LevelTrace)
+	client.SetLogLevel(gobt.LogTracker, slog.LevelDebug)
+	client.SetLogLevel(gobt.LogStorage, slog.LevelWarn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	torrent := downloadTestTorrent(t, ctx, client, newTestSwarm(t, "content", make([]byte, TestSeedLength)), nil)
+	client.Close()
+
+	hash := torrent.InfoHash()
+	tests := map[string]struct {
+		record string
+		logged bool
+	}{
+		"wire trace of read":  {record: "msg=read subsystem=wire torrent=" + hex.EncodeToString(hash[:]), logged: true},
+		"wire trace of write": {record: "msg=write subsystem=wire", logged: true},
+		"tracker debug":       {record: "msg=announced subsystem=tracker", logged: true},
+		"storage below level": {record: "subsystem=storage", logged: false},
+	}
+
+	logs := out.String()
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := strings.Contains(logs, test.record); got != test.logged {
+				t.Fatalf("want %q logged %t, got %t", test.record, test.logged, got)
+			}
+		})
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	torrent := downloadTestTorrent(t, ctx, client, newTestSwarm(t, "content", make([]byte, TestSeedLength)), nil)
+
+	rec := httptest.NewRecorder()
+	client.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if typ := rec.Header().Get("Content-Type"); !strings.HasPrefix(typ, "text/plain; version=0.0.4") {
+		t.Fatalf("want Prometheus text format, got %q", typ)
+	}
+
+	hash := torrent.InfoHash()
+	labels := `{torrent="` + hex.EncodeToString(hash[:]) + `",name="content"`
+	tests := map[string]string{
+		"bytes down":     "gobt_downloaded_bytes_total" + labels + "} " + strconv.Itoa(TestSeedLength),
+		"pieces":         "gobt_pieces_verified_total" + labels + "} " + strconv.Itoa(torrent.Layout().PieceCount()),
+		"no hash fails":  "gobt_pieces_failed_total" + labels + "} 0",
+		"tracker errors": "gobt_tracker_errors_total" + labels + "} 0",
+		"picker mode":    "gobt_picker_mode" + labels + `,mode="endgame"} 1`,
+		"disk queue":     "gobt_disk_queue_depth 0",
+		"memory limit":   "gobt_memory_limit_bytes " + strconv.FormatFloat(gobt.DefaultMemoryLimit, 'g', -1, 64),
+		"counter type":   "# TYPE gobt_uploaded_bytes_total counter",
+	}
+
+	body := rec.Body.String()
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			if !strings.Contains(body, want+"\n") {
+				t.Fatalf("want %q, got %s", want, body)
+			}
+		})
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	tests := map[string]struct {
+		handler http.HandlerFunc
+		wantErr bool
+	}{
+		"ok": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				bencode.Marshal(w, gobt.AnnounceResponse{Interval: 1800})
+			},
+		},
+		"stats": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				query := r.URL.Query()
+				if query.Get("uploaded") != "1" || query.Get("downloaded") != "2" || query.Get("left") != strconv.Itoa(TestSeedLength) {
+					http.Error(w, "bad stats", http.StatusBadRequest)
+					return
+				}
+				bencode.Marshal(w, gobt.AnnounceResponse{Interval: 1800})
+			},
+		},
+		"failure reason": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				bencode.Marshal(w, gobt.AnnounceResponse{Failure: "unregistered torrent"})
+			},
+			wantErr: true,
+		},
+		"bad status": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				bencode.Marshal(w, gobt.AnnounceResponse{Interval: 1800})
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tracker := httptest.NewServer(test.handler)
+			defer tracker.Close()
+
+			_, err := gobt.Announce(context.Background(), tracker.URL, [20]byte{}, [20]byte{}, gobt.AnnounceStats{Uploaded: 1, Downloaded: 2, Left: TestSeedLength}, gobt.DefaultListenPort)
+			if test.wantErr && err == nil {
+				t.Fatalf("want err, got nil")
+			}
+			if !test.wantErr && err != nil {
+				t.Fatalf("want nil, got err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestTorrentAnnounceFailure(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	m := newTestSwarm(t, "content", make([]byte, TestSeedLength))
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer tracker.Close()
+	m.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sub *gobt.Subscription
+	torrent := startTestTorrent(t, ctx, client, m, func(torrent *gobt.Torrent) {
+		sub = torrent.Subscribe(gobt.DefaultEventBuffer)
+	})
+
+	for e := range sub.Events() {
+		if e.Type != gobt.EventAnnounce {
+			continue
+		}
+
+		if e.Err == nil {
+			t.Fatalf("want failed announce, got %+v", e)
+		}
+		break
+	}
+
+	// Torrent keeps running and retries
+	if err := torrent.Err(); err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+
+	if state := torrent.State(); state != gobt.StateDownloading {
+		t.Fatalf("want %s, got %s", gobt.StateDownloading, state)
+	}
+
+	torrent.Pause()
+	if err := torrent.Start(ctx); err != nil {
+		t.Fatalf("want nil, got err: %s", err.Error())
+	}
+}
@@ -0,0 +1,146 @@
+package gobt
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Period of samples in transfer rate average
+	RateTick = time.Second
+	// Weight of the newest sample in transfer rate average
+	RateSmoothing = 0.2
+)
+
+// TransferStats counts bytes exchanged with peers. Payload bytes are piece
+// data, protocol bytes are everything else including message headers.
+type TransferStats struct {
+	Downloaded         int64
+	Uploaded           int64
+	DownloadedProtocol int64
+	UploadedProtocol   int64
+
+	// Payload rates in bytes per second
+	DownloadRate float64
+	UploadRate   float64
+
+	LastRecv time.Time
+	LastSent time.Time
+}
+
+// PeerStats is snapshot of peer state and transfer.
+type PeerStats struct {
+	Addr string
+	TransferStats
+
+	QueueDepth int
+	Requests   int
+	Wasted     int
+
+	Snubbed bool
+	PeerState
+}
+
+// rateMeter estimates rate as exponentially weighted moving average of
+// bytes per RateTick.
+type rateMeter struct {
+	rate  float64
+	bytes int64
+	tick  time.Time
+}
+
+func (m *rateMeter) add(n int, now time.Time) {
+	m.advance(now)
+	m.bytes += int64(n)
+}
+
+func (m *rateMeter) get(now time.Time) float64 {
+	m.advance(now)
+	return m.rate
+}
+
+func (m *rateMeter) advance(now time.Time) {
+	if m.tick.IsZero() {
+		m.tick = now
+		return
+	}
+
+	ticks := int(now.Sub(m.tick) / RateTick)
+	if ticks == 0 {
+		return
+	}
+
+	sample := float64(m.bytes) / RateTick.Seconds()
+	m.rate += RateSmoothing * (sample - m.rate)
+	// Ticks without any bytes decay the rate
+	m.rate *= math.Pow(1-RateSmoothing, float64(ticks-1))
+
+	m.bytes = 0
+	m.tick = m.tick.Add(time.Duration(ticks) * RateTick)
+}
+
+// transferCounters accumulates TransferStats. Bytes are also added to
+// parent, so torrent counters include every peer that was connected.
+type transferCounters struct {
+	stats  TransferStats
+	down   rateMeter
+	up     rateMeter
+	parent *transferCounters
+
+	sync.Mutex
+}
+
+func (c *transferCounters) recv(payload, protocol int, now time.Time) {
+	c.Lock()
+	c.stats.Downloaded += int64(payload)
+	c.stats.DownloadedProtocol += int64(protocol)
+	c.stats.LastRecv = now
+	c.down.add(payload, now)
+	parent := c.parent
+	c.Unlock()
+
+	if parent != nil {
+		parent.recv(payload, protocol, now)
+	}
+}
+
+func (c *transferCounters) sent(payload, protocol int, now time.Time) {
+	c.Lock()
+	c.stats.Uploaded += int64(payload)
+	c.stats.UploadedProtocol += int64(protocol)
+	c.stats.LastSent = now
+	c.up.add(payload, now)
+	parent := c.parent
+	c.Unlock()
+
+	if parent != nil {
+		parent.sent(payload, protocol, now)
+	}
+}
+
+func (c *transferCounters) setParent(parent *transferCounters) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.parent = parent
+}
+
+// downloadRate returns payload download rate in bytes per second.
+func (c *transferCounters) downloadRate(now time.Time) float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.down.get(now)
+}
+
+func (c *transferCounters) snapshot(now time.Time) TransferStats {
+	c.Lock()
+	defer c.Unlock()
+
+	stats := c.stats
+	stats.DownloadRate = c.down.get(now)
+	stats.UploadRate = c.up.get(now)
+
+	return stats
+}
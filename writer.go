@@ -0,0 +1,198 @@
+package gobt
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/edwces/gobt/protocol"
+)
+
+const (
+	// Messages other than piece data that can wait to be written
+	MaxControlQueue = 256
+	// Piece messages that can wait to be written
+	MaxDataQueue = 64
+
+	WriteBufferSize = 64 * 1024
+)
+
+// ErrWriteQueueFull is returned when peer does not read messages fast enough
+// to keep outbound queue bounded.
+var ErrWriteQueueFull = errors.New("write queue full")
+
+type outMsg struct {
+	msg *protocol.Message
+	buf []byte
+}
+
+// peerWriter writes messages to connection from its own goroutine, so
+// callers never block on slow peers. Control messages are written before
+// piece data, and queued messages are coalesced into one buffered write.
+type peerWriter struct {
+	conn net.Conn
+	peer *Peer
+
+	control   chan outMsg
+	data      chan outMsg
+	keepAlive chan time.Duration
+	closed    chan struct{}
+
+	err error
+	mu  sync.Mutex
+}
+
+func newPeerWriter(conn net.Conn, peer *Peer) *peerWriter {
+	return &peerWriter{
+		conn:      conn,
+		peer:      peer,
+		control:   make(chan outMsg, MaxControlQueue),
+		data:      make(chan outMsg, MaxDataQueue),
+		keepAlive: make(chan time.Duration),
+		closed:    make(chan struct{}),
+	}
+}
+
+// enqueue queues message without blocking.
+func (w *peerWriter) enqueue(msg *protocol.Message) (int, error) {
+	out := outMsg{msg: msg, buf: msg.Marshal()}
+
+	queue := w.control
+	if !msg.KeepAlive && msg.ID == protocol.IDPiece {
+		queue = w.data
+	}
+
+	select {
+	case <-w.closed:
+		return 0, w.closeErr()
+	default:
+	}
+
+	select {
+	case queue <- out:
+		return len(out.buf), nil
+	default:
+		return 0, ErrWriteQueueFull
+	}
+}
+
+func (w *peerWriter) setKeepAlive(period time.Duration) {
+	select {
+	case w.keepAlive <- period:
+	case <-w.closed:
+	}
+}
+
+func (w *peerWriter) closeErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	return net.ErrClosed
+}
+
+func (w *peerWriter) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+
+	w.peer.Close()
+}
+
+func (w *peerWriter) run() {
+	bw := bufio.NewWriterSize(w.conn, WriteBufferSize)
+
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+	var period time.Duration
+
+	for {
+		var out outMsg
+
+		select {
+		case <-w.closed:
+			return
+		case period = <-w.keepAlive:
+			resetTimer(timer, period)
+			continue
+		case <-timer.C:
+			out = outMsg{msg: &protocol.Message{KeepAlive: true}}
+			out.buf = out.msg.Marshal()
+		case out = <-w.control:
+		case out = <-w.data:
+		}
+
+		// Write everything that is queued, then flush at once
+		for ok := true; ok; out, ok = w.next() {
+			err := w.write(bw, out)
+			if err != nil {
+				w.fail(err)
+				return
+			}
+		}
+
+		err := bw.Flush()
+		if err != nil {
+			w.fail(err)
+			return
+		}
+
+		resetTimer(timer, period)
+	}
+}
+
+// next returns queued message, control messages first.
+func (w *peerWriter) next() (outMsg, bool) {
+	select {
+	case out := <-w.control:
+		return out, true
+	default:
+	}
+
+	select {
+	case out := <-w.control:
+		return out, true
+	case out := <-w.data:
+		return out, true
+	default:
+		return outMsg{}, false
+	}
+}
+
+func (w *peerWriter) write(bw *bufio.Writer, out outMsg) error {
+	waitUpload(w.peer.bandwidthLimits(), len(out.buf))
+
+	_, err := bw.Write(out.buf)
+	if err != nil {
+		return err
+	}
+
+	payload, proto := messageSize(out.msg)
+	w.peer.counters.sent(payload, proto, time.Now())
+	w.peer.trace("write", out.msg, len(out.buf))
+
+	return nil
+}
+
+func resetTimer(timer *time.Timer, period time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+
+	if period > 0 {
+		timer.Reset(period)
+	}
+}